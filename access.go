@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// AccessConfig limits the users of a rule to the RRD files under its paths.
+// A path is a "root:path:to:dir" prefix or a glob of one, where "*" also
+// matches ":" like in path rules. Users may be "*" for every user.
+type AccessConfig struct {
+	Users []string `yaml:"users"`
+	Paths []string `yaml:"paths"`
+}
+
+// pathAccess reports whether the user of a request may read the RRD file of a
+// "root:path:to:file" target. A nil pathAccess allows every file.
+type pathAccess func(fileTarget string) bool
+
+func checkAccess(a AuthConfig) error {
+	if len(a.Access) == 0 {
+		return nil
+	}
+	// Anonymous requests have no user to look up the rules of
+	if len(a.Read) == 0 {
+		return errors.New("access rules need read users")
+	}
+	for i, rule := range a.Access {
+		if len(rule.Users) == 0 || len(rule.Paths) == 0 {
+			return fmt.Errorf("access rule %d needs users and paths", i+1)
+		}
+		for _, pattern := range rule.Paths {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("invalid path %q in access rule %d", pattern, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// accessFor returns the files the user of a request may read. Once access
+// rules are configured, users can only read the files of their rules.
+func (s *rrdServer) accessFor(r *http.Request) pathAccess {
+	if len(s.config.Auth.Access) == 0 {
+		return nil
+	}
+	user := authUser(r)
+	var patterns []string
+	for _, rule := range s.config.Auth.Access {
+		if slices.Contains(rule.Users, user) || slices.Contains(rule.Users, "*") {
+			patterns = append(patterns, rule.Paths...)
+		}
+	}
+	return func(fileTarget string) bool {
+		return matchesPathPrefix(patterns, fileTarget)
+	}
+}
+
+// matchesPathPrefix reports whether a pattern matches a target or one of the
+// directories it is in
+func matchesPathPrefix(patterns []string, target string) bool {
+	parts := strings.Split(target, ":")
+	for i := 1; i <= len(parts); i++ {
+		prefix := strings.Join(parts[:i], ":")
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, prefix); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a pathAccess) allows(fileTarget string) bool {
+	return a == nil || a(fileTarget)
+}
+
+// searchItems returns the "path:to:file:ds" items of cache in files the user
+// may read
+func (a pathAccess) searchItems(cache *SearchCache) []string {
+	items := cache.Get()
+	if a == nil {
+		return items
+	}
+	allowed := make([]string, 0, len(items))
+	for _, item := range items {
+		if i := strings.LastIndex(item, ":"); i > 0 && a(item[:i]) {
+			allowed = append(allowed, item)
+		}
+	}
+	return allowed
+}
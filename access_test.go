@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPathAccess(t *testing.T) {
+	config := sampleConfig()
+	config.Auth = AuthConfig{
+		Tokens: []TokenConfig{{Name: "alice", Token: "alice-token"}, {Name: "bob", Token: "bob-token"}, {Name: "carol", Token: "carol-token"}},
+		Read:   []string{"*"},
+		Access: []AccessConfig{
+			{Users: []string{"alice"}, Paths: []string{"percent"}},
+			{Users: []string{"bob"}, Paths: []string{"librenms:h*"}},
+		},
+	}
+	if err := checkAuth(config.Auth); err != nil {
+		t.Fatalf("Cannot check auth settings. %v", err)
+	}
+	s := newTestServer(t, config)
+
+	post := func(handler http.HandlerFunc, token, body string, res interface{}) int {
+		ts := httptest.NewServer(s.withAuth(authRead, handler))
+		defer ts.Close()
+		req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error at an POST request. %v", err)
+		}
+		json.NewDecoder(r.Body).Decode(res)
+		return r.StatusCode
+	}
+
+	var lsResult LsResponse
+	post(s.ls, "alice-token", `{}`, &lsResult)
+	if len(lsResult.Directories) != 1 || lsResult.Directories[0] != "percent" {
+		t.Fatalf("Alice should only see percent. %+v", lsResult)
+	}
+	post(s.ls, "carol-token", `{}`, &lsResult)
+	if len(lsResult.Directories) != 0 || len(lsResult.Files) != 0 {
+		t.Fatalf("Users without a rule shouldn't see any file. %+v", lsResult)
+	}
+
+	var searchResult []string
+	post(s.search, "bob-token", `{"target":"e"}`, &searchResult)
+	if len(searchResult) == 0 {
+		t.Fatal("Bob should find the librenms files.")
+	}
+	for _, item := range searchResult {
+		if !strings.HasPrefix(item, "librenms:host:") {
+			t.Fatalf("Bob shouldn't find %s.", item)
+		}
+	}
+
+	var infoResult InfoResponse
+	if status := post(s.info, "alice-token", `{"target":"percent:percent-idle"}`, &infoResult); status != http.StatusOK {
+		t.Fatalf("Alice should read percent files but %d.", status)
+	}
+	if status := post(s.info, "bob-token", `{"target":"percent:percent-idle"}`, &infoResult); status != http.StatusNotFound {
+		t.Fatalf("Files of other users should be missing but %d.", status)
+	}
+
+	// Wildcards are expanded to the allowed files only
+	req := httptest.NewRequest("POST", "/query", nil)
+	if jobs, _ := s.expandTarget("*:*:value", "", func(fileTarget string) bool { return strings.HasPrefix(fileTarget, "percent:") }); len(jobs) != 2 {
+		t.Fatalf("Expected the 2 percent files. %+v", jobs)
+	}
+	if jobs, _ := s.expandTarget("percent:*:value", "", s.accessFor(req)); len(jobs) != 0 {
+		t.Fatalf("Requests without a user shouldn't read any file. %+v", jobs)
+	}
+}
+
+func TestMatchesPathPrefix(t *testing.T) {
+	for _, test := range []struct {
+		patterns []string
+		target   string
+		expected bool
+	}{
+		{[]string{"librenms:customer-a"}, "librenms:customer-a:port-1", true},
+		{[]string{"librenms:customer-a"}, "librenms:customer-ab:port-1", false},
+		{[]string{"librenms:customer-a-*"}, "librenms:customer-a-router1:port-1", true},
+		{[]string{"librenms:*:port-1"}, "librenms:customer-a:port-1", true},
+		{[]string{"librenms:*:port-1"}, "librenms:customer-a:port-2", false},
+		{[]string{"*"}, "collectd:host:load", true},
+		{nil, "collectd:host:load", false},
+	} {
+		if matchesPathPrefix(test.patterns, test.target) != test.expected {
+			t.Fatalf("%v on %s should be %v.", test.patterns, test.target, test.expected)
+		}
+	}
+
+	for _, a := range []AuthConfig{
+		{Access: []AccessConfig{{Users: []string{"alice"}, Paths: []string{"percent"}}}},
+		{Read: []string{"alice"}, Access: []AccessConfig{{Users: []string{"alice"}}}},
+		{Read: []string{"alice"}, Access: []AccessConfig{{Users: []string{"alice"}, Paths: []string{"percent:["}}}},
+	} {
+		if err := checkAccess(a); err == nil {
+			t.Fatalf("%+v should be rejected.", a)
+		}
+	}
+}
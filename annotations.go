@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocarina/gocsv"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// AnnotationSource is a store of annotations, such as a CSV file or a SQLite
+// database. Annotations returns those matching a query.
+type AnnotationSource interface {
+	Annotations(q annotationQuery) ([]*AnnotationCSV, error)
+}
+
+// annotationQuery selects annotations overlapping from and to, in
+// milliseconds. The query text of Grafana's annotation settings can name tags
+// as "tag:name", which annotations need all of, or any of with "match:any",
+// and limit the sources by name as "source:name". Other words are ignored, so
+// queries written for other datasources still return everything.
+type annotationQuery struct {
+	from, to int64
+	tags     []string
+	matchAny bool
+	sources  []string
+}
+
+var annotationSourceTypes = []string{"csv", "jsonl", "dir", "sqlite"}
+
+// validTableName matches the SQLite table names of sqlite sources
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func parseAnnotationQuery(from, to int64, query string) annotationQuery {
+	q := annotationQuery{from: from, to: to}
+	for _, word := range strings.Fields(query) {
+		if tag, ok := strings.CutPrefix(word, "tag:"); ok && tag != "" {
+			q.tags = append(q.tags, tag)
+		} else if word == "match:any" {
+			q.matchAny = true
+		} else if word == "match:all" {
+			q.matchAny = false
+		} else if source, ok := strings.CutPrefix(word, "source:"); ok && source != "" {
+			q.sources = append(q.sources, source)
+		}
+	}
+	return q
+}
+
+// matches tells whether an annotation overlaps the time range and has the
+// tags of the query
+func (q annotationQuery) matches(a *AnnotationCSV) bool {
+	if a.Time > q.to || max(a.Time, a.TimeEnd) < q.from {
+		return false
+	}
+	if len(q.tags) == 0 {
+		return true
+	}
+	tags := splitTags(a.Tags)
+	for _, tag := range q.tags {
+		found := slices.Contains(tags, tag)
+		if found && q.matchAny {
+			return true
+		}
+		if !found && !q.matchAny {
+			return false
+		}
+	}
+	return !q.matchAny
+}
+
+// splitTags returns the tags of an annotation, which are separated by commas
+func splitTags(tags string) []string {
+	result := []string{}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// UnmarshalJSON reads an annotation of a JSON lines file, whose tags can be
+// an array as well as a string separated by commas
+func (a *AnnotationCSV) UnmarshalJSON(data []byte) error {
+	type plain AnnotationCSV
+	v := struct {
+		*plain
+		Tags json.RawMessage `json:"tags"`
+	}{plain: (*plain)(a)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	a.Tags = ""
+	if len(v.Tags) == 0 || string(v.Tags) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(v.Tags, &a.Tags); err == nil {
+		return nil
+	}
+	var tags []string
+	if err := json.Unmarshal(v.Tags, &tags); err != nil {
+		return errors.New("tags must be a string or an array of strings")
+	}
+	a.Tags = strings.Join(tags, ",")
+	return nil
+}
+
+// selects tells whether the query reads a source. Unnamed sources are only
+// read by queries that don't name sources.
+func (q annotationQuery) selects(name string) bool {
+	if len(q.sources) == 0 {
+		return true
+	}
+	return slices.Contains(q.sources, name)
+}
+
+// namedSource is an annotation source with the name and path it has in the
+// config
+type namedSource struct {
+	name, path string
+	AnnotationSource
+}
+
+// annotationSources returns the -a file followed by the configured sources
+func (config *Config) annotationSources() []namedSource {
+	var sources []namedSource
+	if config.Server.AnnotationFilePath != "" {
+		sources = append(sources, namedSource{
+			path:             config.Server.AnnotationFilePath,
+			AnnotationSource: csvAnnotations(config.Server.AnnotationFilePath),
+		})
+	}
+	for _, sc := range config.Annotations {
+		sources = append(sources, namedSource{name: sc.Name, path: sc.Path, AnnotationSource: newAnnotationSource(sc)})
+	}
+	return sources
+}
+
+// newAnnotationSource creates the source of a config entry, which has been
+// checked by checkAnnotationSource
+func newAnnotationSource(sc AnnotationSourceConfig) AnnotationSource {
+	switch annotationSourceType(sc) {
+	case "jsonl":
+		return jsonlAnnotations(sc.Path)
+	case "dir":
+		return dirAnnotations(sc.Path)
+	case "sqlite":
+		table := sc.Table
+		if table == "" {
+			table = "annotations"
+		}
+		return sqliteAnnotations{path: sc.Path, table: table}
+	}
+	return csvAnnotations(sc.Path)
+}
+
+// annotationSourceType returns the type of a source. Without a type, it is
+// guessed from the path: a directory, a .jsonl or .ndjson file, a .db,
+// .sqlite or .sqlite3 file, or a CSV file otherwise.
+func annotationSourceType(sc AnnotationSourceConfig) string {
+	if sc.Type != "" {
+		return sc.Type
+	}
+	if stat, err := os.Stat(sc.Path); err == nil && stat.IsDir() {
+		return "dir"
+	}
+	switch strings.ToLower(filepath.Ext(sc.Path)) {
+	case ".jsonl", ".ndjson":
+		return "jsonl"
+	case ".db", ".sqlite", ".sqlite3":
+		return "sqlite"
+	}
+	return "csv"
+}
+
+func checkAnnotationSource(sc AnnotationSourceConfig) error {
+	if sc.Path == "" {
+		return fmt.Errorf("annotation source %q has no path", sc.Name)
+	}
+	if sc.Type != "" && !slices.Contains(annotationSourceTypes, sc.Type) {
+		return fmt.Errorf("unknown type %q of annotation source %s", sc.Type, sc.Path)
+	}
+	if sc.Table != "" && (annotationSourceType(sc) != "sqlite" || !validTableName.MatchString(sc.Table)) {
+		return fmt.Errorf("invalid table %q of annotation source %s", sc.Table, sc.Path)
+	}
+	if sc.Writable && annotationSourceType(sc) != "csv" {
+		return fmt.Errorf("annotation source %s is writable but not a CSV file", sc.Path)
+	}
+	return nil
+}
+
+// csvAnnotations is a CSV file with a "time,title,tags,text" header
+type csvAnnotations string
+
+func (path csvAnnotations) Annotations(q annotationQuery) ([]*AnnotationCSV, error) {
+	csvFile, err := os.Open(string(path))
+	if err != nil {
+		return nil, err
+	}
+	defer csvFile.Close()
+
+	annots := []*AnnotationCSV{}
+	if err := gocsv.UnmarshalFile(csvFile, &annots); err != nil {
+		return nil, err
+	}
+	return filterAnnotations(annots, q), nil
+}
+
+// jsonlAnnotations is a file with an annotation object per line, e.g.
+// {"time":1494763899000,"title":"Deployed","tags":["app1"],"text":"v1.2"}.
+// Empty lines are skipped.
+type jsonlAnnotations string
+
+func (path jsonlAnnotations) Annotations(q annotationQuery) ([]*AnnotationCSV, error) {
+	file, err := os.Open(string(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	annots := []*AnnotationCSV{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var a AnnotationCSV
+		if err := json.Unmarshal([]byte(text), &a); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		annots = append(annots, &a)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return filterAnnotations(annots, q), nil
+}
+
+// dirAnnotations is a directory of CSV and JSON lines files, told apart by
+// their extensions. Other files and subdirectories are ignored, and a file
+// that can't be read doesn't hide the others.
+type dirAnnotations string
+
+func (dir dirAnnotations) Annotations(q annotationQuery) ([]*AnnotationCSV, error) {
+	entries, err := os.ReadDir(string(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	annots := []*AnnotationCSV{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		filePath := filepath.Join(string(dir), entry.Name())
+		var source AnnotationSource
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".csv":
+			source = csvAnnotations(filePath)
+		case ".jsonl", ".ndjson":
+			source = jsonlAnnotations(filePath)
+		default:
+			continue
+		}
+		found, err := source.Annotations(q)
+		if err != nil {
+			logger.Error("Cannot read annotations file", "path", filePath, "error", err)
+			continue
+		}
+		annots = append(annots, found...)
+	}
+	return annots, nil
+}
+
+// sqliteAnnotations is a table of a SQLite database with time, title, tags
+// and text columns, and an optional timeEnd column for regions. The database
+// is opened read-only for each query.
+type sqliteAnnotations struct {
+	path  string
+	table string
+}
+
+func (s sqliteAnnotations) Annotations(q annotationQuery) ([]*AnnotationCSV, error) {
+	// Characters such as "?" and "#" in the path would end it in a plain DSN.
+	// The path is made absolute, as the first segment of a relative one would
+	// be read as the host of the URL.
+	absPath, err := filepath.Abs(s.path)
+	if err != nil {
+		return nil, err
+	}
+	uriPath := filepath.ToSlash(absPath)
+	if !strings.HasPrefix(uriPath, "/") {
+		// Windows paths start with the drive letter
+		uriPath = "/" + uriPath
+	}
+	dsn := url.URL{Scheme: "file", Path: uriPath, RawQuery: "mode=ro"}
+	db, err := sql.Open("sqlite3", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	timeEnd := "0"
+	var hasTimeEnd bool
+	err = db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = 'timeEnd'`, s.table).Scan(&hasTimeEnd)
+	if err != nil {
+		return nil, err
+	}
+	if hasTimeEnd {
+		timeEnd = "COALESCE(timeEnd, 0)"
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT time, %[2]s, COALESCE(title, ''), COALESCE(tags, ''), COALESCE(text, '')
+		FROM "%[1]s" WHERE time <= ? AND MAX(time, %[2]s) >= ? ORDER BY time`, s.table, timeEnd), q.to, q.from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	annots := []*AnnotationCSV{}
+	for rows.Next() {
+		var a AnnotationCSV
+		if err := rows.Scan(&a.Time, &a.TimeEnd, &a.Title, &a.Tags, &a.Text); err != nil {
+			return nil, err
+		}
+		annots = append(annots, &a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return filterAnnotations(annots, q), nil
+}
+
+func filterAnnotations(annots []*AnnotationCSV, q annotationQuery) []*AnnotationCSV {
+	filtered := annots[:0]
+	for _, a := range annots {
+		if q.matches(a) {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
+}
+
+// annotations serves the annotations of all sources selected by the query,
+// sorted by time, or those of a derived query. A source that can't be read is
+// logged and skipped.
+func (s *rrdServer) annotations(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Write(nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var annotationRequest AnnotationRequest
+	err := decoder.Decode(&annotationRequest)
+	defer r.Body.Close()
+	if err != nil {
+		logger.Error("Cannot decode annotation request", "error", err)
+		result := ErrorResponse{Message: "Cannot decode the request"}
+		respondJSON(w, result)
+		return
+	}
+
+	from, _ := time.Parse(time.RFC3339Nano, annotationRequest.Range.From)
+	to, _ := time.Parse(time.RFC3339Nano, annotationRequest.Range.To)
+
+	derived, ok, err := parseDerivedQuery(annotationRequest.Annotation.Query)
+	if err != nil {
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	if ok {
+		annots, err := s.deriveAnnotations(derived, from, to, s.accessFor(r))
+		if err != nil {
+			respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+			return
+		}
+		respondAnnotations(w, annots)
+		return
+	}
+
+	sources := s.config.annotationSources()
+	if len(sources) == 0 {
+		result := ErrorResponse{Message: "Not configured"}
+		respondJSON(w, result)
+		return
+	}
+
+	q := parseAnnotationQuery(from.Unix()*1000, to.Unix()*1000, annotationRequest.Annotation.Query)
+	q.tags = append(q.tags, annotationRequest.Annotation.Tags...)
+	q.matchAny = q.matchAny || annotationRequest.Annotation.MatchAny
+
+	annots := []*AnnotationCSV{}
+	for _, source := range sources {
+		if !q.selects(source.name) {
+			continue
+		}
+		found, err := source.Annotations(q)
+		if err != nil {
+			logger.Error("Cannot read annotation source", "path", source.path, "error", err)
+			continue
+		}
+		annots = append(annots, found...)
+	}
+	respondAnnotations(w, annots)
+}
+
+func respondAnnotations(w http.ResponseWriter, annots []*AnnotationCSV) {
+	sort.SliceStable(annots, func(i, j int) bool { return annots[i].Time < annots[j].Time })
+	result := []AnnotationResponse{}
+	for _, a := range annots {
+		result = append(result, annotationResponse(a))
+	}
+	respondJSON(w, result)
+}
+
+// annotationResponse converts an annotation to the response format. An
+// annotation with a TimeEnd after its Time is a region.
+func annotationResponse(a *AnnotationCSV) AnnotationResponse {
+	result := AnnotationResponse{
+		Annotation: "annotation",
+		ID:         a.ID,
+		Time:       a.Time,
+		Title:      a.Title,
+		Tags:       splitTags(a.Tags),
+		Text:       a.Text,
+	}
+	if a.TimeEnd > a.Time {
+		result.TimeEnd = a.TimeEnd
+		result.IsRegion = true
+	}
+	return result
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, filePath, content string) {
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Cannot write %s. %v", filePath, err)
+	}
+}
+
+func annotationTitles(t *testing.T, source AnnotationSource, q annotationQuery) []string {
+	annots, err := source.Annotations(q)
+	if err != nil {
+		t.Fatalf("Cannot read annotations. %v", err)
+	}
+	titles := make([]string, len(annots))
+	for i, a := range annots {
+		titles[i] = a.Title
+	}
+	return titles
+}
+
+func TestAnnotationSources(t *testing.T) {
+	dir := t.TempDir()
+	everything := annotationQuery{from: 0, to: 1 << 62}
+
+	jsonl := filepath.Join(dir, "events.jsonl")
+	writeFile(t, jsonl, `{"time":1000,"title":"Deployed","tags":"deploy,app1","text":"v1.2"}
+
+{"time":2000,"title":"Rolled back","tags":["deploy", "app2"],"text":""}
+`)
+	if titles := annotationTitles(t, jsonlAnnotations(jsonl), everything); len(titles) != 2 || titles[1] != "Rolled back" {
+		t.Fatalf("Unexpected JSON lines annotations. %v", titles)
+	}
+	annots, _ := jsonlAnnotations(jsonl).Annotations(annotationQuery{from: 2000, to: 2000, tags: []string{"app2"}})
+	if len(annots) != 1 || annots[0].Tags != "deploy,app2" {
+		t.Fatalf("Tags can be an array. %+v", annots)
+	}
+
+	events := filepath.Join(dir, "events")
+	os.Mkdir(events, 0755)
+	writeFile(t, filepath.Join(events, "a.csv"), "time,title,tags,text\n3000,Maintenance,ops,\n")
+	writeFile(t, filepath.Join(events, "b.ndjson"), `{"time":4000,"title":"Reboot","tags":"ops"}`+"\n")
+	writeFile(t, filepath.Join(events, "broken.jsonl"), "{\n")
+	writeFile(t, filepath.Join(events, "README"), "not annotations\n")
+	if titles := annotationTitles(t, dirAnnotations(events), everything); len(titles) != 2 {
+		t.Fatalf("Unexpected directory annotations. %v", titles)
+	}
+
+	// "#" would end the path in a plain "file:" DSN
+	database := filepath.Join(dir, "events#1.db")
+	db, err := sql.Open("sqlite3", database)
+	if err != nil {
+		t.Fatalf("Cannot open database. %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE changes (time INTEGER, title TEXT, tags TEXT, text TEXT);
+		INSERT INTO changes VALUES (5000, 'Firmware upgrade', 'ops,network', NULL), (9000, 'Later', NULL, NULL);
+		CREATE TABLE windows (time INTEGER, timeEnd INTEGER, title TEXT, tags TEXT, text TEXT);
+		INSERT INTO windows VALUES (1000, 8000, 'Maintenance', 'ops', NULL), (7000, NULL, 'Reboot', NULL, NULL)`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Cannot create table. %v", err)
+	}
+	source := newAnnotationSource(AnnotationSourceConfig{Path: database, Table: "changes"})
+	if titles := annotationTitles(t, source, annotationQuery{from: 0, to: 6000}); len(titles) != 1 || titles[0] != "Firmware upgrade" {
+		t.Fatalf("Unexpected SQLite annotations. %v", titles)
+	}
+	// Relative paths are relative to the working directory
+	wd, _ := os.Getwd()
+	relative, err := filepath.Rel(wd, database)
+	if err != nil {
+		t.Fatalf("Cannot make the path relative. %v", err)
+	}
+	source = newAnnotationSource(AnnotationSourceConfig{Path: relative, Table: "changes"})
+	if titles := annotationTitles(t, source, annotationQuery{from: 0, to: 6000}); len(titles) != 1 {
+		t.Fatalf("Unexpected SQLite annotations of a relative path. %v", titles)
+	}
+	source = newAnnotationSource(AnnotationSourceConfig{Path: database, Table: "windows"})
+	if titles := annotationTitles(t, source, annotationQuery{from: 6000, to: 6500}); len(titles) != 1 || titles[0] != "Maintenance" {
+		t.Fatalf("Regions overlapping the range should be returned. %v", titles)
+	}
+
+	for sc, expected := range map[AnnotationSourceConfig]string{
+		{Path: events}:                     "dir",
+		{Path: jsonl}:                      "jsonl",
+		{Path: database}:                   "sqlite",
+		{Path: "./sample/annotations.csv"}: "csv",
+		{Path: jsonl, Type: "csv"}:         "csv",
+	} {
+		if st := annotationSourceType(sc); st != expected {
+			t.Fatalf("Type of %+v should be %s but %s.", sc, expected, st)
+		}
+	}
+	for _, sc := range []AnnotationSourceConfig{
+		{},
+		{Path: jsonl, Type: "xml"},
+		{Path: jsonl, Table: "changes"},
+		{Path: database, Table: `changes"; DROP TABLE changes; --`},
+	} {
+		if err := checkAnnotationSource(sc); err == nil {
+			t.Fatalf("%+v should be rejected.", sc)
+		}
+	}
+}
+
+func TestAnnotationQuery(t *testing.T) {
+	q := parseAnnotationQuery(1000, 5000, "#deploy tag:app1 tag:deploy source:changes")
+	if len(q.tags) != 2 || len(q.sources) != 1 {
+		t.Fatalf("Unexpected query. %+v", q)
+	}
+
+	for _, test := range []struct {
+		a        AnnotationCSV
+		expected bool
+	}{
+		{AnnotationCSV{Time: 1000, Tags: "deploy, app1"}, true},
+		{AnnotationCSV{Time: 5000, Tags: "app1,deploy,app2"}, true},
+		{AnnotationCSV{Time: 5001, Tags: "app1,deploy"}, false},
+		{AnnotationCSV{Time: 2000, Tags: "deploy"}, false},
+		{AnnotationCSV{Time: 2000, Tags: "app10,deploy"}, false},
+	} {
+		if q.matches(&test.a) != test.expected {
+			t.Fatalf("matches(%+v) should be %v.", test.a, test.expected)
+		}
+	}
+
+	if !q.selects("changes") || q.selects("") || q.selects("other") {
+		t.Fatal("Only named sources should be selected.")
+	}
+	if q := parseAnnotationQuery(0, 0, "#deploy"); !q.selects("") || len(q.tags) != 0 {
+		t.Fatalf("Other words should be ignored. %+v", q)
+	}
+
+	q = parseAnnotationQuery(1000, 5000, "tag:app1 tag:app2 match:any")
+	for tags, expected := range map[string]bool{
+		"app1":        true,
+		"deploy,app2": true,
+		"deploy":      false,
+		"":            false,
+	} {
+		if q.matches(&AnnotationCSV{Time: 2000, Tags: tags}) != expected {
+			t.Fatalf("matches(%q) with match:any should be %v.", tags, expected)
+		}
+	}
+
+	q = parseAnnotationQuery(3000, 4000, "")
+	for _, test := range []struct {
+		a        AnnotationCSV
+		expected bool
+	}{
+		{AnnotationCSV{Time: 1000, TimeEnd: 2999}, false},
+		{AnnotationCSV{Time: 1000, TimeEnd: 3000}, true},
+		{AnnotationCSV{Time: 1000, TimeEnd: 9000}, true},
+		{AnnotationCSV{Time: 4001, TimeEnd: 9000}, false},
+	} {
+		if q.matches(&test.a) != test.expected {
+			t.Fatalf("matches(%+v) should be %v.", test.a, test.expected)
+		}
+	}
+}
+
+func TestAnnotationResponse(t *testing.T) {
+	res := annotationResponse(&AnnotationCSV{Time: 1000, TimeEnd: 2000, Tags: "deploy, app1,"})
+	if !res.IsRegion || res.TimeEnd != 2000 || len(res.Tags) != 2 || res.Tags[1] != "app1" {
+		t.Fatalf("Unexpected region. %+v", res)
+	}
+	res = annotationResponse(&AnnotationCSV{Time: 1000})
+	if res.IsRegion || res.TimeEnd != 0 || res.Tags == nil {
+		t.Fatalf("Unexpected annotation. %+v", res)
+	}
+}
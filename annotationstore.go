@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocarina/gocsv"
+)
+
+// AnnotationEvent is an annotation posted to /annotations/events. Times are
+// in milliseconds; Time defaults to now and TimeEnd, for a region, is zero
+// for a single point in time.
+type AnnotationEvent struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd"`
+	Title   string   `json:"title"`
+	Tags    []string `json:"tags"`
+	Text    string   `json:"text"`
+}
+
+// annotationStore is the writable CSV source. Every change rewrites the file
+// to a temporary one that replaces it, so readers never see a partial file.
+// Writers are serialized by a mutex within the server and by a lock on a
+// ".lock" file next to the CSV file across processes. The lock file also
+// holds the last id given out, so the id of a deleted annotation isn't given
+// to a new one.
+type annotationStore string
+
+var annotationStoreMutex sync.Mutex
+
+var errNoAnnotation = errors.New("no such annotation")
+
+// writableAnnotationStore returns the store of the writable source. The
+// config file can have only one.
+func (config *Config) writableAnnotationStore() (annotationStore, bool) {
+	for _, sc := range config.Annotations {
+		if sc.Writable {
+			return annotationStore(sc.Path), true
+		}
+	}
+	return "", false
+}
+
+// modify applies change to the annotations of the store under the locks.
+// change gets new ids from nextID. Annotations without an id, such as rows
+// added by hand, get one first.
+func (s annotationStore) modify(change func(annots []*AnnotationCSV, nextID func() int64) ([]*AnnotationCSV, error)) error {
+	annotationStoreMutex.Lock()
+	defer annotationStoreMutex.Unlock()
+
+	lock, err := os.OpenFile(string(s)+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	// Closing the file releases the lock
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+
+	annots, err := s.read()
+	if err != nil {
+		return err
+	}
+	lastID, err := readLastID(lock)
+	if err != nil {
+		return err
+	}
+	// Ids may also have been written by hand
+	for _, a := range annots {
+		lastID = max(lastID, a.ID)
+	}
+	savedID := lastID
+	nextID := func() int64 {
+		lastID++
+		return lastID
+	}
+	for _, a := range annots {
+		if a.ID == 0 {
+			a.ID = nextID()
+		}
+	}
+
+	if annots, err = change(annots, nextID); err != nil {
+		return err
+	}
+	// The id is saved first, so a failed write skips ids rather than
+	// reusing them
+	if lastID != savedID {
+		if err := writeLastID(lock, lastID); err != nil {
+			return err
+		}
+	}
+	return s.write(annots)
+}
+
+// readLastID reads the last id given out from the lock file. A new lock file
+// is empty.
+func readLastID(lock *os.File) (int64, error) {
+	content, err := io.ReadAll(lock)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid last annotation id in %s: %w", lock.Name(), err)
+	}
+	return id, nil
+}
+
+func writeLastID(lock *os.File, id int64) error {
+	if err := lock.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := lock.WriteAt([]byte(strconv.FormatInt(id, 10)+"\n"), 0); err != nil {
+		return err
+	}
+	return lock.Sync()
+}
+
+// read returns the annotations of the store. A missing file has none.
+func (s annotationStore) read() ([]*AnnotationCSV, error) {
+	annots := []*AnnotationCSV{}
+	csvFile, err := os.Open(string(s))
+	if os.IsNotExist(err) {
+		return annots, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer csvFile.Close()
+
+	if err := gocsv.UnmarshalFile(csvFile, &annots); err != nil {
+		return nil, err
+	}
+	return annots, nil
+}
+
+func (s annotationStore) write(annots []*AnnotationCSV) error {
+	mode := os.FileMode(0644)
+	if stat, err := os.Stat(string(s)); err == nil {
+		mode = stat.Mode().Perm()
+	}
+
+	dir, base := filepath.Split(string(s))
+	tmp, err := os.CreateTemp(dir, "."+base+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gocsv.MarshalFile(&annots, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), string(s))
+}
+
+// add stores a new annotation and returns it with its id
+func (s annotationStore) add(a AnnotationCSV) (AnnotationCSV, error) {
+	err := s.modify(func(annots []*AnnotationCSV, nextID func() int64) ([]*AnnotationCSV, error) {
+		a.ID = nextID()
+		return append(annots, &a), nil
+	})
+	return a, err
+}
+
+// remove deletes the annotation with an id and returns it
+func (s annotationStore) remove(id int64) (AnnotationCSV, error) {
+	var removed AnnotationCSV
+	err := s.modify(func(annots []*AnnotationCSV, _ func() int64) ([]*AnnotationCSV, error) {
+		for i, a := range annots {
+			if a.ID == id {
+				removed = *a
+				return append(annots[:i], annots[i+1:]...), nil
+			}
+		}
+		return nil, errNoAnnotation
+	})
+	return removed, err
+}
+
+// annotationEvents creates annotations with POST /annotations/events and
+// deletes them with DELETE /annotations/events/<id>. Both respond with the
+// annotation as /annotations returns it.
+func (s *rrdServer) annotationEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "accept, authorization, content-type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST,DELETE,OPTIONS")
+		w.Write(nil)
+		return
+	}
+
+	idPath := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/annotations/events"), "/")
+	allowed := "POST, OPTIONS"
+	if idPath != "" {
+		allowed = "DELETE, OPTIONS"
+	}
+	if (idPath == "" && r.Method != http.MethodPost) || (idPath != "" && r.Method != http.MethodDelete) {
+		w.Header().Set("Allow", allowed)
+		respondJSONStatus(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "Method not allowed"})
+		return
+	}
+	store, ok := s.config.writableAnnotationStore()
+	if !ok {
+		respondJSONStatus(w, http.StatusNotFound, ErrorResponse{Message: "No writable annotation source is configured"})
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		id, err := strconv.ParseInt(idPath, 10, 64)
+		if err != nil || id <= 0 {
+			respondJSONStatus(w, http.StatusNotFound, ErrorResponse{Message: "No annotation " + idPath})
+			return
+		}
+		removed, err := store.remove(id)
+		if errors.Is(err, errNoAnnotation) {
+			respondJSONStatus(w, http.StatusNotFound, ErrorResponse{Message: "No annotation " + idPath})
+			return
+		}
+		if err != nil {
+			logger.Error("Cannot delete annotation", "path", string(store), "id", id, "error", err)
+			respondJSONStatus(w, http.StatusInternalServerError, ErrorResponse{Message: "Cannot delete the annotation"})
+			return
+		}
+		logger.Info("Deleted annotation", "id", id, "title", removed.Title)
+		respondJSON(w, annotationResponse(&removed))
+		return
+	}
+
+	var event AnnotationEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		logger.Error("Cannot decode annotation event", "error", err)
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: "Cannot decode the request"})
+		return
+	}
+	defer r.Body.Close()
+
+	a, err := newAnnotation(event, time.Now())
+	if err != nil {
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	if a, err = store.add(a); err != nil {
+		logger.Error("Cannot store annotation", "path", string(store), "error", err)
+		respondJSONStatus(w, http.StatusInternalServerError, ErrorResponse{Message: "Cannot store the annotation"})
+		return
+	}
+	logger.Info("Created annotation", "id", a.ID, "title", a.Title)
+	respondJSONStatus(w, http.StatusCreated, annotationResponse(&a))
+}
+
+// newAnnotation checks a posted event and converts it to a stored
+// annotation. Tags are stored separated by commas, so they can't contain one.
+func newAnnotation(event AnnotationEvent, now time.Time) (AnnotationCSV, error) {
+	if event.Title == "" && event.Text == "" {
+		return AnnotationCSV{}, errors.New("an annotation needs a title or text")
+	}
+	if event.Time == 0 {
+		event.Time = now.UnixMilli()
+	}
+	if event.Time < 0 || (event.TimeEnd != 0 && event.TimeEnd < event.Time) {
+		return AnnotationCSV{}, fmt.Errorf("invalid time range %d-%d", event.Time, event.TimeEnd)
+	}
+	tags := make([]string, 0, len(event.Tags))
+	for _, tag := range event.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || strings.Contains(tag, ",") {
+			return AnnotationCSV{}, fmt.Errorf("invalid tag %q", tag)
+		}
+		tags = append(tags, tag)
+	}
+
+	return AnnotationCSV{
+		Time:    event.Time,
+		TimeEnd: event.TimeEnd,
+		Title:   event.Title,
+		Tags:    strings.Join(tags, ","),
+		Text:    event.Text,
+	}, nil
+}
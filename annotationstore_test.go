@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAnnotationEvents(t *testing.T) {
+	csvPath := filepath.Join(t.TempDir(), "events.csv")
+	writeFile(t, csvPath, "time,title,tags,text\n1000,Added by hand,ops,\n")
+	s := &rrdServer{}
+	s.config.Server.WriteToken = "secret"
+	s.config.Annotations = []AnnotationSourceConfig{{Path: csvPath, Writable: true}}
+
+	ts := httptest.NewServer(s.withAuth(authWrite, s.annotationEvents))
+	defer ts.Close()
+
+	send := func(method, path, body string) (int, AnnotationResponse) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error at a %s request. %v", method, err)
+		}
+		var res AnnotationResponse
+		json.NewDecoder(r.Body).Decode(&res)
+		return r.StatusCode, res
+	}
+
+	status, res := send("POST", "/annotations/events", `{"time":2000,"timeEnd":3000,"title":"Deployed v2","tags":["deploy","app1"]}`)
+	if status != http.StatusCreated || res.ID != 2 || !res.IsRegion || len(res.Tags) != 2 {
+		t.Fatalf("Unexpected response. %d %+v", status, res)
+	}
+
+	annots, err := annotationStore(csvPath).read()
+	if err != nil || len(annots) != 2 {
+		t.Fatalf("Cannot read the stored annotations. %v %v", annots, err)
+	}
+	if annots[0].ID != 1 || annots[1].TimeEnd != 3000 {
+		t.Fatalf("Rows without an id should get one. %+v %+v", annots[0], annots[1])
+	}
+
+	if status, res := send("DELETE", "/annotations/events/1", ""); status != http.StatusOK || res.Title != "Added by hand" {
+		t.Fatalf("Cannot delete an annotation. %d %+v", status, res)
+	}
+	for _, test := range []struct {
+		method, path, body string
+		expected           int
+	}{
+		{"DELETE", "/annotations/events/1", "", http.StatusNotFound},
+		{"DELETE", "/annotations/events/x", "", http.StatusNotFound},
+		{"DELETE", "/annotations/events", "", http.StatusMethodNotAllowed},
+		{"POST", "/annotations/events/2", "", http.StatusMethodNotAllowed},
+		{"POST", "/annotations/events", `{"tags":["deploy"]}`, http.StatusBadRequest},
+		{"POST", "/annotations/events", `{"title":"x","time":2000,"timeEnd":1000}`, http.StatusBadRequest},
+		{"POST", "/annotations/events", `{"title":"x","tags":["a,b"]}`, http.StatusBadRequest},
+	} {
+		if status, _ := send(test.method, test.path, test.body); status != test.expected {
+			t.Fatalf("Expected %d for %s %s %s but %d.", test.expected, test.method, test.path, test.body, status)
+		}
+	}
+
+	// The highest id isn't given out again after its annotation is deleted
+	if status, _ := send("DELETE", "/annotations/events/2", ""); status != http.StatusOK {
+		t.Fatalf("Cannot delete an annotation. %d", status)
+	}
+	if status, res := send("POST", "/annotations/events", `{"title":"Deployed v3"}`); status != http.StatusCreated || res.ID != 3 {
+		t.Fatalf("A deleted id shouldn't be reused. %d %+v", status, res)
+	}
+
+	s.config.Annotations[0].Writable = false
+	if status, _ := send("POST", "/annotations/events", `{"title":"x"}`); status != http.StatusNotFound {
+		t.Fatalf("Writes need a writable source but %d.", status)
+	}
+}
+
+func TestAnnotationStoreConcurrency(t *testing.T) {
+	store := annotationStore(filepath.Join(t.TempDir(), "events.csv"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := store.add(AnnotationCSV{Time: int64(i), Title: fmt.Sprint(i)}); err != nil {
+				t.Errorf("Cannot add an annotation. %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	annots, err := store.read()
+	if err != nil || len(annots) != 20 {
+		t.Fatalf("Every annotation should be stored. %d %v", len(annots), err)
+	}
+	ids := map[int64]bool{}
+	for _, a := range annots {
+		ids[a.ID] = true
+	}
+	if len(ids) != 20 {
+		t.Fatalf("Ids should be unique. %v", ids)
+	}
+}
+
+func TestNewAnnotation(t *testing.T) {
+	now := time.UnixMilli(5000)
+	a, err := newAnnotation(AnnotationEvent{Title: "x", Tags: []string{" deploy ", "app1"}}, now)
+	if err != nil || a.Time != 5000 || a.Tags != "deploy,app1" {
+		t.Fatalf("Unexpected annotation. %+v %v", a, err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthConfig enables authentication. Users are the names of the bearer
+// tokens and the users of an htpasswd file, which needs bcrypt hashes
+// (htpasswd -B). Read and Write list the users allowed to call the read
+// and write endpoints; "*" allows every user. Without Read, reads are open
+// to anyone, and without Write, writes are disabled. Writers can read too.
+type AuthConfig struct {
+	Tokens   []TokenConfig  `yaml:"tokens"`
+	Htpasswd string         `yaml:"htpasswd"`
+	Read     []string       `yaml:"read"`
+	Write    []string       `yaml:"write"`
+	Access   []AccessConfig `yaml:"access"`
+}
+
+// TokenConfig is a static bearer token and the user it authenticates
+type TokenConfig struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+// Endpoint groups of withAuth
+const (
+	authRead  = "read"
+	authWrite = "write"
+)
+
+// writeTokenUser is the user of the -write-token token, which may write
+const writeTokenUser = "write-token"
+
+type authUserKey struct{}
+
+func checkAuth(a AuthConfig) error {
+	names := map[string]bool{}
+	for _, t := range a.Tokens {
+		if t.Name == "" || t.Token == "" || names[t.Name] {
+			return fmt.Errorf("token without a name or token, or duplicate token %q", t.Name)
+		}
+		names[t.Name] = true
+	}
+	if a.Htpasswd != "" {
+		if _, err := htpasswd.users(a.Htpasswd); err != nil {
+			return err
+		}
+	}
+	return checkAccess(a)
+}
+
+// withAuth makes a handler of an endpoint group require authentication. The
+// user is added to the request context, see authUser. Preflight requests
+// aren't authenticated, as browsers send them without credentials.
+func (s *rrdServer) withAuth(group string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			handler(&preflightWriter{ResponseWriter: w}, r)
+			return
+		}
+
+		allowed := s.allowedUsers(group)
+		if len(allowed) == 0 {
+			if group == authRead {
+				handler(w, r)
+			} else {
+				respondJSONStatus(w, http.StatusForbidden, ErrorResponse{Message: "Writes are disabled"})
+			}
+			return
+		}
+
+		user, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="grafana-rrd-server"`)
+			if s.config.Auth.Htpasswd != "" {
+				w.Header().Add("WWW-Authenticate", `Basic realm="grafana-rrd-server"`)
+			}
+			respondJSONStatus(w, http.StatusUnauthorized, ErrorResponse{Message: "Unauthorized"})
+			return
+		}
+		if !slices.Contains(allowed, "*") && !slices.Contains(allowed, user) {
+			logger.Warn("Denied request", "user", user, "path", r.URL.Path)
+			respondJSONStatus(w, http.StatusForbidden, ErrorResponse{Message: "Forbidden"})
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, user)))
+	}
+}
+
+// allowedUsers returns the users of an endpoint group. No users means the
+// group is open for reads and disabled for writes.
+func (s *rrdServer) allowedUsers(group string) []string {
+	writers := slices.Clone(s.config.Auth.Write)
+	if s.config.Server.WriteToken != "" {
+		writers = append(writers, writeTokenUser)
+	}
+	if group == authWrite {
+		return writers
+	}
+	if len(s.config.Auth.Read) == 0 {
+		return nil
+	}
+	return append(writers, s.config.Auth.Read...)
+}
+
+// authUser returns the user of an authenticated request, or "" if the
+// endpoint is open
+func authUser(r *http.Request) string {
+	user, _ := r.Context().Value(authUserKey{}).(string)
+	return user
+}
+
+// authenticate checks the bearer token or basic auth credentials of a
+// request and returns the user
+func (s *rrdServer) authenticate(r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		user := ""
+		tokens := s.config.Auth.Tokens
+		if s.config.Server.WriteToken != "" {
+			tokens = append(slices.Clone(tokens), TokenConfig{Name: writeTokenUser, Token: s.config.Server.WriteToken})
+		}
+		// Every token is compared so the time taken doesn't tell which one
+		// is close. The hashes are compared as they all have the same
+		// length, which ConstantTimeCompare would give away for the tokens.
+		presented := sha256.Sum256([]byte(token))
+		for _, t := range tokens {
+			configured := sha256.Sum256([]byte(t.Token))
+			if subtle.ConstantTimeCompare(presented[:], configured[:]) == 1 {
+				user = t.Name
+			}
+		}
+		return user, user != ""
+	}
+
+	name, password, ok := r.BasicAuth()
+	if !ok || s.config.Auth.Htpasswd == "" {
+		return "", false
+	}
+	if err := htpasswd.verify(s.config.Auth.Htpasswd, name, password); err != nil {
+		if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) && !errors.Is(err, errUnknownUser) {
+			logger.Error("Cannot check basic auth credentials", "path", s.config.Auth.Htpasswd, "error", err)
+		}
+		return "", false
+	}
+	return name, true
+}
+
+var errUnknownUser = errors.New("unknown user")
+
+// htpasswdFile reads an htpasswd file again when it changes. bcrypt is slow
+// by design, so verified credentials are remembered until then.
+type htpasswdFile struct {
+	m        sync.Mutex
+	path     string
+	modTime  time.Time
+	hashes   map[string][]byte
+	verified map[[sha256.Size]byte]bool
+}
+
+var htpasswd = &htpasswdFile{}
+
+// users returns the password hashes of the users of an htpasswd file
+func (h *htpasswdFile) users(path string) (map[string][]byte, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.load(path)
+}
+
+func (h *htpasswdFile) load(path string) (map[string][]byte, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if path == h.path && stat.ModTime().Equal(h.modTime) {
+		return h.hashes, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := map[string][]byte{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(text, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid line %d of %s", line, path)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("user %s in %s doesn't have a bcrypt hash", name, path)
+		}
+		hashes[name] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	h.path, h.modTime, h.hashes = path, stat.ModTime(), hashes
+	h.verified = map[[sha256.Size]byte]bool{}
+	return hashes, nil
+}
+
+func (h *htpasswdFile) verify(path, name, password string) error {
+	h.m.Lock()
+	hashes, err := h.load(path)
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+	verified := h.verified[key]
+	h.m.Unlock()
+	if err != nil {
+		return err
+	}
+	if verified {
+		return nil
+	}
+
+	hash, ok := hashes[name]
+	if !ok {
+		return errUnknownUser
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return err
+	}
+
+	h.m.Lock()
+	if h.path == path && h.verified != nil {
+		h.verified[key] = true
+	}
+	h.m.Unlock()
+	return nil
+}
+
+// preflightWriter adds Authorization to the headers a handler allows in its
+// response to a preflight request
+type preflightWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *preflightWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.Header()
+		if allowed := header.Get("Access-Control-Allow-Headers"); allowed != "" && !strings.Contains(allowed, "authorization") {
+			header.Set("Access-Control-Allow-Headers", allowed+", authorization")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *preflightWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestWithAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Cannot hash password. %v", err)
+	}
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	writeFile(t, htpasswdPath, "# users\nalice:"+string(hash)+"\n")
+
+	s := &rrdServer{}
+	s.config.Auth = AuthConfig{
+		Tokens:   []TokenConfig{{Name: "grafana", Token: "read-token"}, {Name: "deploy", Token: "deploy-token"}},
+		Htpasswd: htpasswdPath,
+		Read:     []string{"grafana", "alice"},
+		Write:    []string{"deploy"},
+	}
+	if err := checkAuth(s.config.Auth); err != nil {
+		t.Fatalf("Cannot check auth settings. %v", err)
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, authUser(r))
+	}
+	request := func(group, method string, set func(r *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/query", nil)
+		if set != nil {
+			set(req)
+		}
+		w := httptest.NewRecorder()
+		s.withAuth(group, handler)(w, req)
+		return w
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	basic := func(name, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(name, password) }
+	}
+
+	for _, test := range []struct {
+		name     string
+		group    string
+		set      func(r *http.Request)
+		expected int
+		user     string
+	}{
+		{"read token", authRead, bearer("read-token"), http.StatusOK, "grafana"},
+		{"writers can read", authRead, bearer("deploy-token"), http.StatusOK, "deploy"},
+		{"basic auth", authRead, basic("alice", "s3cret"), http.StatusOK, "alice"},
+		{"basic auth again", authRead, basic("alice", "s3cret"), http.StatusOK, "alice"},
+		{"wrong password", authRead, basic("alice", "wrong"), http.StatusUnauthorized, ""},
+		{"unknown user", authRead, basic("bob", "s3cret"), http.StatusUnauthorized, ""},
+		{"wrong token", authRead, bearer("wrong"), http.StatusUnauthorized, ""},
+		{"no credentials", authRead, nil, http.StatusUnauthorized, ""},
+		{"write token", authWrite, bearer("deploy-token"), http.StatusOK, "deploy"},
+		{"readers can't write", authWrite, bearer("read-token"), http.StatusForbidden, ""},
+	} {
+		w := request(test.group, "GET", test.set)
+		if w.Code != test.expected {
+			t.Fatalf("%s: expected %d but %d.", test.name, test.expected, w.Code)
+		}
+		if test.user != "" && w.Body.String() != `"`+test.user+`"` {
+			t.Fatalf("%s: expected user %s but %s.", test.name, test.user, w.Body.String())
+		}
+	}
+	if w := request(authRead, "GET", nil); len(w.Header().Values("WWW-Authenticate")) != 2 {
+		t.Fatalf("Both schemes should be offered. %v", w.Header())
+	}
+
+	// Preflight requests are sent without credentials
+	w := httptest.NewRecorder()
+	s.withAuth(authRead, s.ls)(w, httptest.NewRequest("OPTIONS", "/ls", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Headers") != "accept, content-type, authorization" {
+		t.Fatalf("Unexpected preflight response. %d %v", w.Code, w.Header())
+	}
+
+	// The htpasswd file is read again when it changes
+	writeFile(t, htpasswdPath, "bob:"+string(hash)+"\n")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(htpasswdPath, later, later)
+	s.config.Auth.Read = []string{"*"}
+	if w := request(authRead, "GET", basic("alice", "s3cret")); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Removed users should be rejected but %d.", w.Code)
+	}
+	if w := request(authRead, "GET", basic("bob", "s3cret")); w.Code != http.StatusOK {
+		t.Fatalf("Added users should be accepted but %d.", w.Code)
+	}
+
+	s.config.Auth = AuthConfig{}
+	if w := request(authRead, "GET", nil); w.Code != http.StatusOK {
+		t.Fatalf("Reads should be open without read users but %d.", w.Code)
+	}
+	if w := request(authWrite, "POST", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("Writes should be disabled without write users but %d.", w.Code)
+	}
+	s.config.Server.WriteToken = "secret"
+	if w := request(authWrite, "POST", bearer("secret")); w.Code != http.StatusOK || w.Body.String() != `"write-token"` {
+		t.Fatalf("The write token should be allowed to write. %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCheckAuth(t *testing.T) {
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	writeFile(t, htpasswdPath, "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+
+	for _, a := range []AuthConfig{
+		{Tokens: []TokenConfig{{Name: "grafana"}}},
+		{Tokens: []TokenConfig{{Name: "a", Token: "x"}, {Name: "a", Token: "y"}}},
+		{Htpasswd: htpasswdPath},
+		{Htpasswd: htpasswdPath + ".missing"},
+	} {
+		if err := checkAuth(a); err == nil {
+			t.Fatalf("%+v should be rejected.", a)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RootConfig is a directory of RRD files served under a name prefix. Step
+// and Multiplier default to the server's -s and -m values.
+type RootConfig struct {
+	Name       string  `yaml:"name"`
+	Path       string  `yaml:"path"`
+	Step       int     `yaml:"step"`
+	Multiplier float64 `yaml:"multiplier"`
+	RrdCached  string  `yaml:"rrdCached"`
+}
+
+// PathConfig overrides settings for the targets matching a pattern. Match is
+// a glob over the colon separated target, such as "librenms:*:port-*:*OCTETS",
+// where "*" also matches colons. For each setting the first matching rule
+// that sets it applies. Unit is a Grafana unit id such as "bps" or "percent".
+type PathConfig struct {
+	Match      string  `yaml:"match"`
+	Multiplier float64 `yaml:"multiplier"`
+	Unit       string  `yaml:"unit"`
+}
+
+// TemplateConfig defines the RRD files /create makes. Step defaults to the
+// step of the root the file is created in.
+type TemplateConfig struct {
+	Name        string                     `yaml:"name"`
+	Step        int                        `yaml:"step"`
+	DataSources []TemplateDataSourceConfig `yaml:"dataSources"`
+	RRAs        []TemplateArchiveConfig    `yaml:"rras"`
+}
+
+// TemplateDataSourceConfig is a DS of a template. Min and Max are unbounded
+// when left out.
+type TemplateDataSourceConfig struct {
+	Name      string   `yaml:"name"`
+	Type      string   `yaml:"type"`
+	Heartbeat int      `yaml:"heartbeat"`
+	Min       *float64 `yaml:"min"`
+	Max       *float64 `yaml:"max"`
+}
+
+// TemplateArchiveConfig is an RRA of a template
+type TemplateArchiveConfig struct {
+	CF        string  `yaml:"cf"`
+	XFF       float64 `yaml:"xff"`
+	PdpPerRow int     `yaml:"pdpPerRow"`
+	Rows      int     `yaml:"rows"`
+}
+
+// validDSName matches the names rrdtool accepts for data sources
+var validDSName = regexp.MustCompile(`^[a-zA-Z0-9_]{1,19}$`)
+
+// dsTypes are the DS types a template can use
+var dsTypes = []string{"GAUGE", "COUNTER", "DERIVE", "DCOUNTER", "DDERIVE", "ABSOLUTE"}
+
+// AlertingConfig holds the alert rules. Rules are evaluated every Interval
+// and state changes are posted to Webhook unless a rule has its own.
+type AlertingConfig struct {
+	Interval string       `yaml:"interval"`
+	Webhook  string       `yaml:"webhook"`
+	Rules    []RuleConfig `yaml:"rules"`
+}
+
+// RuleConfig is an alert rule. Target, CF, Reducer, Window and Conditions
+// work as in /evaluate; a series is alerting once the conditions have held
+// for For.
+type RuleConfig struct {
+	Name       string              `yaml:"name"`
+	Target     string              `yaml:"target"`
+	CF         string              `yaml:"cf"`
+	Reducer    string              `yaml:"reducer"`
+	Window     string              `yaml:"window"`
+	Conditions []EvaluateCondition `yaml:"conditions"`
+	For        string              `yaml:"for"`
+	Webhook    string              `yaml:"webhook"`
+}
+
+// AnnotationSourceConfig is a file, directory or database annotations are
+// read from. Type is csv, jsonl, dir or sqlite, and guessed from Path when
+// empty. Table is the table of a sqlite source. Queries can select sources
+// by Name. Annotations posted to /annotations/events are stored in the one
+// Writable source, which must be a CSV file.
+type AnnotationSourceConfig struct {
+	Name     string `yaml:"name"`
+	Path     string `yaml:"path"`
+	Type     string `yaml:"type"`
+	Table    string `yaml:"table"`
+	Writable bool   `yaml:"writable"`
+}
+
+// loadConfigFile fills config from a YAML file. Keys missing from the file
+// keep their current values and unknown keys are rejected, so typos don't go
+// unnoticed.
+func loadConfigFile(config *Config, filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("cannot parse %s: %w", filePath, err)
+	}
+
+	for _, p := range config.Paths {
+		if _, err := path.Match(p.Match, ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q in %s: %w", p.Match, filePath, err)
+		}
+	}
+	writable := 0
+	for _, sc := range config.Annotations {
+		if err := checkAnnotationSource(sc); err != nil {
+			return fmt.Errorf("%w in %s", err, filePath)
+		}
+		if sc.Writable {
+			writable++
+		}
+	}
+	if writable > 1 {
+		return fmt.Errorf("more than one writable annotation source in %s", filePath)
+	}
+	names := map[string]bool{}
+	for _, t := range config.Templates {
+		if names[t.Name] {
+			return fmt.Errorf("duplicate template %q in %s", t.Name, filePath)
+		}
+		names[t.Name] = true
+		if err := checkTemplate(t); err != nil {
+			return fmt.Errorf("invalid template %q in %s: %w", t.Name, filePath, err)
+		}
+	}
+	if err := checkAlerting(config.Alerting); err != nil {
+		return fmt.Errorf("invalid alerting settings in %s: %w", filePath, err)
+	}
+	if err := checkAuth(config.Auth); err != nil {
+		return fmt.Errorf("invalid auth settings in %s: %w", filePath, err)
+	}
+	return nil
+}
+
+func checkTemplate(t TemplateConfig) error {
+	if t.Name == "" {
+		return errors.New("no name")
+	}
+	if t.Step < 0 {
+		return errors.New("negative step")
+	}
+	if len(t.DataSources) == 0 || len(t.RRAs) == 0 {
+		return errors.New("a template needs data sources and RRAs")
+	}
+	dsNames := map[string]bool{}
+	for _, ds := range t.DataSources {
+		if !validDSName.MatchString(ds.Name) || dsNames[ds.Name] {
+			return fmt.Errorf("invalid or duplicate data source name %q", ds.Name)
+		}
+		dsNames[ds.Name] = true
+		if !slices.Contains(dsTypes, ds.Type) {
+			return fmt.Errorf("unknown type %q of data source %s", ds.Type, ds.Name)
+		}
+		if ds.Heartbeat <= 0 {
+			return fmt.Errorf("data source %s needs a heartbeat", ds.Name)
+		}
+	}
+	for _, rra := range t.RRAs {
+		if !hasCF(consolidationFunctions, rra.CF) {
+			return fmt.Errorf("unknown consolidation function %q", rra.CF)
+		}
+		if rra.XFF < 0 || rra.XFF >= 1 || rra.PdpPerRow <= 0 || rra.Rows <= 0 {
+			return fmt.Errorf("RRA %+v needs 0 <= xff < 1 and positive pdpPerRow and rows", rra)
+		}
+	}
+	return nil
+}
+
+func checkAlerting(a AlertingConfig) error {
+	if interval, err := parseOptionalDuration(a.Interval, defaultRuleInterval); err != nil || interval == 0 {
+		return fmt.Errorf("invalid interval %q", a.Interval)
+	}
+	if err := checkWebhook(a.Webhook); err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, rule := range a.Rules {
+		if rule.Name == "" || names[rule.Name] {
+			return fmt.Errorf("rule without a name or duplicate rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Target == "" {
+			return fmt.Errorf("rule %q has no target", rule.Name)
+		}
+		if _, err := parseReducer(rule.Reducer); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if len(rule.Conditions) == 0 {
+			return fmt.Errorf("rule %q has no conditions", rule.Name)
+		}
+		for _, c := range rule.Conditions {
+			if _, err := compare(c.Op, 0, c.Value); err != nil {
+				return fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+		}
+		if _, err := parseOptionalDuration(rule.Window, defaultEvaluateWindow); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if _, err := parseOptionalDuration(rule.For, "0"); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if err := checkWebhook(rule.Webhook); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// parseOptionalDuration parses a duration like "5m" or "0", using fallback
+// when value is empty
+func parseOptionalDuration(value, fallback string) (time.Duration, error) {
+	if value == "" {
+		value = fallback
+	}
+	if value == "0" {
+		return 0, nil
+	}
+	d, err := parsePromDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+func checkWebhook(webhook string) error {
+	if webhook == "" {
+		return nil
+	}
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", webhook)
+	}
+	return nil
+}
+
+// templateByName returns the configured template called name
+func (config *Config) templateByName(name string) (TemplateConfig, bool) {
+	for _, t := range config.Templates {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return TemplateConfig{}, false
+}
+
+// applyConfigFile loads the file given by -config, then applies the flags set
+// on the command line again so they take precedence over the file
+func applyConfigFile(config *Config, filePath string) error {
+	if filePath == "" {
+		return nil
+	}
+
+	setFlags := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	if err := loadConfigFile(config, filePath); err != nil {
+		return err
+	}
+
+	for name, value := range setFlags {
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// multiplierFor returns the multiplier of the first path rule matching target
+// that sets one, or fallback
+func (config *Config) multiplierFor(target string, fallback float64) float64 {
+	for _, p := range config.Paths {
+		if ok, _ := path.Match(p.Match, target); ok && p.Multiplier != 0 {
+			return p.Multiplier
+		}
+	}
+	return fallback
+}
+
+// unitFor returns the unit of the first path rule matching target that sets
+// one
+func (config *Config) unitFor(target string) string {
+	for _, p := range config.Paths {
+		if ok, _ := path.Match(p.Match, target); ok && p.Unit != "" {
+			return p.Unit
+		}
+	}
+	return ""
+}
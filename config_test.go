@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	filePath := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Cannot write config file. %v", err)
+	}
+	return filePath
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	config := sampleConfig()
+	config.Server.Port = 9000
+
+	err := loadConfigFile(&config, writeConfigFile(t, `
+server:
+  step: 300
+  searchCache: 60
+paths:
+  - match: "librenms:*:port-*"
+    unit: bps
+  - match: "librenms:*:port-*:*OCTETS"
+    multiplier: 8
+  - match: "percent:*"
+    multiplier: 0.01
+annotations:
+  - path: ./sample/annotations.csv
+`))
+	if err != nil {
+		t.Fatalf("Cannot load config file. %v", err)
+	}
+
+	if config.Server.Step != 300 || config.Server.SearchCache != 60 {
+		t.Fatalf("Values in the file aren't loaded. %+v", config.Server)
+	}
+	if config.Server.Port != 9000 || config.Server.RrdPath != "./sample/" {
+		t.Fatalf("Values missing from the file should be kept. %+v", config.Server)
+	}
+
+	for target, expected := range map[string]float64{
+		"librenms:host:port-id66:INOCTETS": 8,
+		"librenms:host:port-id66:INERRORS": 1,
+		"percent:percent-idle:value":       0.01,
+		"sample:ClientJobsIdle":            1,
+	} {
+		if m := config.multiplierFor(target, 1); m != expected {
+			t.Fatalf("Multiplier for %s should be %v but %v.", target, expected, m)
+		}
+	}
+
+	if unit := config.unitFor("librenms:host:port-id66:INOCTETS"); unit != "bps" {
+		t.Fatalf("Unit should come from the first rule setting one but %q.", unit)
+	}
+	if unit := config.unitFor("sample:ClientJobsIdle"); unit != "" {
+		t.Fatalf("Targets without rules shouldn't have a unit but %q.", unit)
+	}
+
+	if sources := config.annotationSources(); len(sources) != 1 || sources[0].AnnotationSource != csvAnnotations("./sample/annotations.csv") {
+		t.Fatalf("Unexpected annotation sources. %v", sources)
+	}
+
+	if err := loadConfigFile(&config, writeConfigFile(t, "server:\n  stpe: 300\n")); err == nil {
+		t.Fatal("Unknown keys should be rejected.")
+	}
+	if err := loadConfigFile(&config, writeConfigFile(t, "paths:\n  - match: \"[\"\n")); err == nil {
+		t.Fatal("Invalid patterns should be rejected.")
+	}
+
+	config.Paths = nil
+	template := `
+templates:
+  - name: gauge
+    dataSources:
+      - {name: value, type: %s, heartbeat: 600}
+    rras:
+      - {cf: AVERAGE, xff: 0.5, pdpPerRow: 1, rows: 2016}
+`
+	if err := loadConfigFile(&config, writeConfigFile(t, fmt.Sprintf(template, "GAUGE"))); err != nil {
+		t.Fatalf("Cannot load a template. %v", err)
+	}
+	if _, ok := config.templateByName("gauge"); !ok {
+		t.Fatal("The template should be found by name.")
+	}
+	if err := loadConfigFile(&config, writeConfigFile(t, fmt.Sprintf(template, "GAGUE"))); err == nil {
+		t.Fatal("Templates with unknown DS types should be rejected.")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	rrdcached "github.com/multiplay/go-rrd"
+	"github.com/ziutek/rrd"
+)
+
+// CreateRequest creates the file of a "path:to:file" target from a template
+// of the config file. Start is the time in milliseconds the file starts at,
+// which defaults to 10 seconds ago like rrdtool create; samples older than
+// it can't be written.
+type CreateRequest struct {
+	Target   string `json:"target"`
+	Template string `json:"template"`
+	Start    int64  `json:"start"`
+}
+
+// create makes a new RRD file and adds it to the search cache. It responds
+// with the header of the file like /info.
+func (s *rrdServer) create(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "accept, authorization, content-type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST,OPTIONS")
+		w.Write(nil)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		respondJSONStatus(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "Method not allowed"})
+		return
+	}
+
+	var createRequest CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&createRequest); err != nil {
+		logger.Error("Cannot decode create request", "error", err)
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: "Cannot decode the request"})
+		return
+	}
+	defer r.Body.Close()
+
+	template, ok := s.config.templateByName(createRequest.Template)
+	if !ok {
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("Unknown template %q", createRequest.Template)})
+		return
+	}
+	if err := checkFileTarget(createRequest.Target); err != nil {
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	root, filePath := s.roots.fileForTarget(createRequest.Target)
+	if root == nil || !root.contains(filePath) || !s.roots.owns(root, filePath) {
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: "No root for target " + createRequest.Target})
+		return
+	}
+	// Paths the user can't read are reported missing before a conflict could
+	// reveal their files
+	if !s.accessFor(r).allows(root.target(filePath)) {
+		respondJSONStatus(w, http.StatusNotFound, ErrorResponse{Message: "No root for target " + createRequest.Target})
+		return
+	}
+	if _, err := os.Lstat(filePath); err == nil {
+		respondJSONStatus(w, http.StatusConflict, ErrorResponse{Message: root.target(filePath) + " already exists"})
+		return
+	}
+
+	start := time.Now().Add(-10 * time.Second)
+	if createRequest.Start != 0 {
+		start = time.UnixMilli(createRequest.Start)
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		logger.Error("Cannot create directory", "path", filepath.Dir(filePath), "error", err)
+		respondJSONStatus(w, http.StatusInternalServerError, ErrorResponse{Message: "Cannot create the directory"})
+		return
+	}
+	if err := root.createRRD(filePath, template, start); err != nil {
+		logger.Error("Cannot create RRD file", "path", filePath, "template", template.Name, "error", err)
+		respondJSONStatus(w, http.StatusInternalServerError, ErrorResponse{Message: "Cannot create the RRD file"})
+		return
+	}
+	logger.Info("Created RRD file", "path", filePath, "template", template.Name)
+
+	s.searchCache.UpdateFile(root, filePath)
+	header, err := root.rrdInfo(filePath)
+	if err != nil {
+		logger.Error("Cannot retrieve information from RRD file", "path", filePath, "error", err)
+		respondJSONStatus(w, http.StatusInternalServerError, ErrorResponse{Message: "Cannot read the RRD file"})
+		return
+	}
+	respondJSONStatus(w, http.StatusCreated, infoResponse(root.target(filePath), header))
+}
+
+// createRRD creates an RRD file from a template, through rrdcached if the
+// root uses it. An existing file is never overwritten.
+func (root *rrdRoot) createRRD(filePath string, template TemplateConfig, start time.Time) error {
+	step := template.Step
+	if step == 0 {
+		step = root.step
+	}
+	bound := func(value *float64) string {
+		if value == nil {
+			return "U"
+		}
+		return strconv.FormatFloat(*value, 'f', -1, 64)
+	}
+
+	if root.cached() {
+		dataSources := make([]rrdcached.DS, len(template.DataSources))
+		for i, ds := range template.DataSources {
+			dataSources[i] = rrdcached.NewDS(fmt.Sprintf("DS:%s:%s:%d:%s:%s", ds.Name, ds.Type, ds.Heartbeat, bound(ds.Min), bound(ds.Max)))
+		}
+		rras := make([]rrdcached.RRA, len(template.RRAs))
+		for i, rra := range template.RRAs {
+			rras[i] = rrdcached.NewRRA(fmt.Sprintf("RRA:%s:%s:%d:%d", rra.CF, strconv.FormatFloat(rra.XFF, 'f', -1, 64), rra.PdpPerRow, rra.Rows))
+		}
+		return root.rrdcached.with(func(client *rrdcached.Client) error {
+			return client.Create(filePath, dataSources, rras,
+				rrdcached.Step(time.Duration(step)*time.Second), rrdcached.Start(start), rrdcached.NoOverwrite())
+		})
+	}
+
+	creator := rrd.NewCreator(filePath, start, uint(step))
+	for _, ds := range template.DataSources {
+		creator.DS(ds.Name, ds.Type, ds.Heartbeat, bound(ds.Min), bound(ds.Max))
+	}
+	for _, rra := range template.RRAs {
+		creator.RRA(rra.CF, rra.XFF, rra.PdpPerRow, rra.Rows)
+	}
+	return creator.Create(false)
+}
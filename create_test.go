@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	config := sampleConfig()
+	config.Roots = []RootConfig{{Name: "tmp", Path: dir, Step: 60}}
+	zero := 0.0
+	config.Templates = []TemplateConfig{{
+		Name: "interface",
+		DataSources: []TemplateDataSourceConfig{
+			{Name: "INOCTETS", Type: "DERIVE", Heartbeat: 120, Min: &zero},
+			{Name: "OUTOCTETS", Type: "DERIVE", Heartbeat: 120, Min: &zero},
+		},
+		RRAs: []TemplateArchiveConfig{
+			{CF: "AVERAGE", XFF: 0.5, PdpPerRow: 1, Rows: 1440},
+			{CF: "MAX", XFF: 0.5, PdpPerRow: 60, Rows: 720},
+		},
+	}}
+	config.Server.WriteToken = "secret"
+	s := newTestServer(t, config)
+
+	ts := httptest.NewServer(s.withAuth(authWrite, s.create))
+	defer ts.Close()
+
+	postAs := func(token, body string) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error at an POST request. %v", err)
+		}
+		return r
+	}
+	post := func(body string) *http.Response {
+		return postAs("secret", body)
+	}
+
+	r := post(`{"target":"tmp:router1:port-eth0","template":"interface"}`)
+	if r.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 but %d.", r.StatusCode)
+	}
+	var res InfoResponse
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		t.Fatalf("Error at decoding JSON response. %v", err)
+	}
+	if res.Target != "tmp:router1:port-eth0" || res.Step != 60 || len(res.DataSources) != 2 || len(res.RRAs) != 2 {
+		t.Fatalf("Unexpected header. %+v", res)
+	}
+	if res.DataSources[0].Min == nil || res.DataSources[0].Max != nil {
+		t.Fatalf("Unexpected bounds. %+v", res.DataSources[0])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "router1", "port-eth0.rrd")); err != nil {
+		t.Fatalf("The file should be created. %v", err)
+	}
+	if !s.searchCache.HasFile("tmp:router1:port-eth0") {
+		t.Fatal("The file should be in the search cache right away.")
+	}
+
+	for body, expected := range map[string]int{
+		`{"target":"tmp:router1:port-eth0","template":"interface"}`: http.StatusConflict,
+		`{"target":"tmp:..:escape","template":"interface"}`:         http.StatusBadRequest,
+		`{"target":"tmp:router1:port-*","template":"interface"}`:    http.StatusBadRequest,
+		`{"target":"tmp:router1:port-eth1","template":"nothing"}`:   http.StatusBadRequest,
+	} {
+		if r := post(body); r.StatusCode != expected {
+			t.Fatalf("Expected %d for %s but %d.", expected, body, r.StatusCode)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape.rrd")); err == nil {
+		t.Fatal("A file outside the root shouldn't be created.")
+	}
+
+	// Writers with access rules can only create files under their paths
+	s.config.Auth = AuthConfig{
+		Tokens: []TokenConfig{{Name: "alice", Token: "alice-token"}},
+		Read:   []string{"alice"},
+		Write:  []string{"alice"},
+		Access: []AccessConfig{{Users: []string{"alice"}, Paths: []string{"tmp:router1"}}},
+	}
+	if r := postAs("alice-token", `{"target":"tmp:router1:port-eth1","template":"interface"}`); r.StatusCode != http.StatusCreated {
+		t.Fatalf("Alice should create files under router1 but %d.", r.StatusCode)
+	}
+	if r := postAs("alice-token", `{"target":"tmp:router2:port-eth0","template":"interface"}`); r.StatusCode != http.StatusNotFound {
+		t.Fatalf("Alice shouldn't create files under router2 but %d.", r.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "router2")); err == nil {
+		t.Fatal("Nothing should be created under router2.")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Derived annotation queries compute annotations from RRD data instead of
+// reading them from a source:
+//
+//   - gaps(target, n) marks periods without data longer than n steps
+//     (default 1) as regions
+//   - resets(target) marks points where a value drops, such as the uptime of
+//     a rebooted device or a counter set back to zero
+//   - crossings(target, x, direction) marks points where a series crosses x,
+//     in both directions or only "above" or "below"
+//
+// The target can be anything a /query target can, including wildcards,
+// consolidation functions and infix expressions.
+
+// derivedQuery is a parsed derived annotation query
+type derivedQuery struct {
+	kind      string
+	target    string
+	steps     float64
+	threshold float64
+	direction string
+}
+
+var derivedQueryPattern = regexp.MustCompile(`^\s*(gaps|resets|crossings)\((.*)\)\s*$`)
+
+// parseDerivedQuery parses the query of an annotation. ok is false for
+// queries that aren't derived ones, which are read from the sources.
+func parseDerivedQuery(query string) (q derivedQuery, ok bool, err error) {
+	m := derivedQueryPattern.FindStringSubmatch(query)
+	if m == nil {
+		return derivedQuery{}, false, nil
+	}
+	q = derivedQuery{kind: m[1], steps: 1}
+	args := splitArgs(m[2])
+	q.target = args[0]
+	if q.target == "" {
+		return q, true, fmt.Errorf("%s needs a target", q.kind)
+	}
+
+	number := func(arg string) (float64, error) {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, fmt.Errorf("invalid number %q in %s", arg, q.kind)
+		}
+		return v, nil
+	}
+	switch {
+	case q.kind == "gaps" && len(args) <= 2:
+		if len(args) == 2 {
+			if q.steps, err = number(args[1]); err != nil || q.steps < 0 {
+				return q, true, fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+	case q.kind == "resets" && len(args) == 1:
+	case q.kind == "crossings" && (len(args) == 2 || len(args) == 3):
+		if q.threshold, err = number(args[1]); err != nil {
+			return q, true, err
+		}
+		if len(args) == 3 {
+			q.direction = args[2]
+			if q.direction != "above" && q.direction != "below" {
+				return q, true, fmt.Errorf("direction must be above or below, not %q", q.direction)
+			}
+		}
+	default:
+		return q, true, fmt.Errorf("wrong number of arguments for %s", q.kind)
+	}
+	return q, true, nil
+}
+
+// splitArgs splits arguments at the commas outside parentheses and braces,
+// so targets can contain function calls and {a,b} alternatives
+func splitArgs(s string) []string {
+	var args []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(', '{', '[':
+			depth++
+		case ')', '}', ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+// deriveAnnotations fetches the series of a derived query over a time range
+// and returns the annotations found in them
+func (s *rrdServer) deriveAnnotations(q derivedQuery, from, to time.Time, access pathAccess) ([]*AnnotationCSV, error) {
+	window := fetchWindow{From: from, To: to, Step: s.queryStep(QueryRequest{}, from, to)}
+	targetSeries, err := s.evalTargets([]QueryTarget{{Target: q.target, RefID: "A"}}, window, access)
+	if err != nil {
+		return nil, err
+	}
+
+	annots := []*AnnotationCSV{}
+	for _, series := range targetSeries[0] {
+		switch q.kind {
+		case "gaps":
+			annots = append(annots, seriesGaps(series, q.steps)...)
+		case "resets":
+			annots = append(annots, seriesResets(series)...)
+		case "crossings":
+			annots = append(annots, seriesCrossings(series, q.threshold, q.direction)...)
+		}
+	}
+	return annots, nil
+}
+
+// seriesStep returns the smallest time between two points of a series in
+// milliseconds, which is the resolution it was fetched with unless every
+// point is followed by a gap
+func seriesStep(series QueryResponse) float64 {
+	step := math.Inf(1)
+	for i := 1; i < len(series.DataPoints); i++ {
+		if d := series.DataPoints[i][1] - series.DataPoints[i-1][1]; d > 0 && d < step {
+			step = d
+		}
+	}
+	return step
+}
+
+// seriesGaps returns a region from the last point before each gap to the
+// first point after it. Missing data before the first point and after the
+// last one isn't marked, as the range may just reach beyond the file's data.
+func seriesGaps(series QueryResponse, steps float64) []*AnnotationCSV {
+	annots := []*AnnotationCSV{}
+	step := seriesStep(series)
+	if math.IsInf(step, 1) {
+		return annots
+	}
+	for i := 1; i < len(series.DataPoints); i++ {
+		start, end := series.DataPoints[i-1][1], series.DataPoints[i][1]
+		if missing := end - start - step; missing > steps*step {
+			annots = append(annots, &AnnotationCSV{
+				Time:    int64(start),
+				TimeEnd: int64(end),
+				Title:   "Gap in " + series.Target,
+				Tags:    "gap",
+				Text:    fmt.Sprintf("No data for %s", time.Duration(missing)*time.Millisecond),
+			})
+		}
+	}
+	return annots
+}
+
+func seriesResets(series QueryResponse) []*AnnotationCSV {
+	annots := []*AnnotationCSV{}
+	for i := 1; i < len(series.DataPoints); i++ {
+		previous, p := series.DataPoints[i-1], series.DataPoints[i]
+		if p[0] < previous[0] {
+			annots = append(annots, &AnnotationCSV{
+				Time:  int64(p[1]),
+				Title: "Reset of " + series.Target,
+				Tags:  "reset",
+				Text:  fmt.Sprintf("Dropped from %s to %s", formatValue(previous[0]), formatValue(p[0])),
+			})
+		}
+	}
+	return annots
+}
+
+// seriesCrossings marks the first point on the other side of the threshold.
+// A series crosses above when it reaches the threshold and below when it
+// falls under it.
+func seriesCrossings(series QueryResponse, threshold float64, direction string) []*AnnotationCSV {
+	annots := []*AnnotationCSV{}
+	for i := 1; i < len(series.DataPoints); i++ {
+		previous, p := series.DataPoints[i-1], series.DataPoints[i]
+		crossed := ""
+		switch {
+		case previous[0] < threshold && p[0] >= threshold:
+			crossed = "above"
+		case previous[0] >= threshold && p[0] < threshold:
+			crossed = "below"
+		}
+		if crossed == "" || (direction != "" && crossed != direction) {
+			continue
+		}
+		annots = append(annots, &AnnotationCSV{
+			Time:  int64(p[1]),
+			Title: fmt.Sprintf("%s crossed %s %s", series.Target, crossed, formatValue(threshold)),
+			Tags:  "crossing," + crossed,
+			Text:  fmt.Sprintf("From %s to %s", formatValue(previous[0]), formatValue(p[0])),
+		})
+	}
+	return annots
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
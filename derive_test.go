@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseDerivedQuery(t *testing.T) {
+	q, ok, err := parseDerivedQuery("gaps(librenms:*:port-{id6,id66}:INOCTETS, 3)")
+	if !ok || err != nil || q.target != "librenms:*:port-{id6,id66}:INOCTETS" || q.steps != 3 {
+		t.Fatalf("Unexpected query. %+v %v %v", q, ok, err)
+	}
+	q, _, err = parseDerivedQuery("crossings(sum(percent:*:value) * 8, 80, below)")
+	if err != nil || q.target != "sum(percent:*:value) * 8" || q.threshold != 80 || q.direction != "below" {
+		t.Fatalf("Unexpected query. %+v %v", q, err)
+	}
+	if q, _, err := parseDerivedQuery("resets(host:uptime:value)"); err != nil || q.kind != "resets" {
+		t.Fatalf("Unexpected query. %+v %v", q, err)
+	}
+
+	for _, query := range []string{"#deploy", "tag:deploy", "", "sum(a:b)"} {
+		if _, ok, _ := parseDerivedQuery(query); ok {
+			t.Fatalf("%q isn't a derived query.", query)
+		}
+	}
+	for _, query := range []string{
+		"gaps()",
+		"gaps(a:b, -1)",
+		"gaps(a:b, 1, 2)",
+		"resets(a:b, 1)",
+		"crossings(a:b)",
+		"crossings(a:b, x)",
+		"crossings(a:b, 1, sideways)",
+	} {
+		if _, ok, err := parseDerivedQuery(query); !ok || err == nil {
+			t.Fatalf("%q should be rejected.", query)
+		}
+	}
+}
+
+func TestDerivedAnnotations(t *testing.T) {
+	series := QueryResponse{Target: "a:b", DataPoints: [][]float64{
+		{10, 1000}, {20, 2000}, {30, 3000}, {5, 5000}, {50, 6000}, {60, 7000}, {70, 11000},
+	}}
+
+	gaps := seriesGaps(series, 1)
+	if len(gaps) != 1 || gaps[0].Time != 7000 || gaps[0].TimeEnd != 11000 || gaps[0].Text != "No data for 3s" {
+		t.Fatalf("Unexpected gaps. %+v", gaps)
+	}
+	if gaps := seriesGaps(series, 0); len(gaps) != 2 {
+		t.Fatalf("A missing point should be a gap of 1 step. %+v", gaps)
+	}
+
+	if resets := seriesResets(series); len(resets) != 1 || resets[0].Time != 5000 || resets[0].Text != "Dropped from 30 to 5" {
+		t.Fatalf("Unexpected resets. %+v", resets)
+	}
+
+	crossings := seriesCrossings(series, 20, "")
+	if len(crossings) != 3 || crossings[0].Time != 2000 || crossings[1].Tags != "crossing,below" {
+		t.Fatalf("Unexpected crossings. %+v", crossings)
+	}
+	if crossings := seriesCrossings(series, 20, "above"); len(crossings) != 2 || crossings[1].Time != 6000 {
+		t.Fatalf("Unexpected crossings above. %+v", crossings)
+	}
+}
+
+func TestAnnotationsDerived(t *testing.T) {
+	s := sampleServer(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.annotations))
+	defer ts.Close()
+
+	post := func(query string) (int, []AnnotationResponse) {
+		body := `{"range":{"from":"2016-12-08T01:30:00Z","to":"2016-12-08T02:05:00Z"},"annotation":{"query":"` + query + `"}}`
+		r, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error at an POST request. %v", err)
+		}
+		var res []AnnotationResponse
+		json.NewDecoder(r.Body).Decode(&res)
+		return r.StatusCode, res
+	}
+
+	// percent-idle and percent-user are between 0 and 100
+	if status, res := post("crossings(percent:percent-*:value, -1)"); status != http.StatusOK || len(res) != 0 {
+		t.Fatalf("Series above the threshold shouldn't cross it. %d %+v", status, res)
+	}
+	status, res := post("gaps(percent:percent-idle:value, 0)")
+	if status != http.StatusOK {
+		t.Fatalf("Derived queries shouldn't need annotation sources. %d", status)
+	}
+	for _, a := range res {
+		if !a.IsRegion || a.Tags[0] != "gap" {
+			t.Fatalf("Gaps should be regions. %+v", a)
+		}
+	}
+	if status, _ := post("crossings(percent:percent-idle:value@FOO, 1)"); status != http.StatusBadRequest {
+		t.Fatalf("Invalid targets should be rejected but %d.", status)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EvaluateRequest checks the series of a target against thresholds. Each
+// series is reduced to one value over the window ending at To, and is
+// alerting when any condition holds for that value.
+type EvaluateRequest struct {
+	Target     string              `json:"target"`
+	CF         string              `json:"cf"`
+	Window     string              `json:"window"`
+	To         string              `json:"to"`
+	Reducer    string              `json:"reducer"`
+	Conditions []EvaluateCondition `json:"conditions"`
+}
+
+// EvaluateCondition compares the reduced value with Value using Op, one of
+// >, >=, <, <=, == and !=
+type EvaluateCondition struct {
+	Op    string  `json:"op" yaml:"op"`
+	Value float64 `json:"value" yaml:"value"`
+}
+
+// EvaluateResponse has the state of each series. State is the worst of
+// them: alerting, then nodata, then ok. A target without series is nodata.
+type EvaluateResponse struct {
+	State  string           `json:"state"`
+	Series []EvaluateSeries `json:"series"`
+}
+
+// EvaluateSeries is the reduced value and state of a series. Value is null
+// for series without data points in the window.
+type EvaluateSeries struct {
+	Target string   `json:"target"`
+	State  string   `json:"state"`
+	Value  *float64 `json:"value"`
+}
+
+const (
+	stateOK       = "ok"
+	stateAlerting = "alerting"
+	stateNoData   = "nodata"
+)
+
+// defaultEvaluateWindow is used when a request has no window
+const defaultEvaluateWindow = "5m"
+
+// evaluate serves /evaluate
+func (s *rrdServer) evaluate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST,OPTIONS")
+		w.Write(nil)
+		return
+	}
+
+	var evaluateRequest EvaluateRequest
+	if err := json.NewDecoder(r.Body).Decode(&evaluateRequest); err != nil {
+		logger.Error("Cannot decode evaluate request", "error", err)
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: "Cannot decode the request"})
+		return
+	}
+	defer r.Body.Close()
+
+	result, err := s.evaluateRequestAt(evaluateRequest, time.Now(), s.accessFor(r))
+	if err != nil {
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	respondJSON(w, result)
+}
+
+// evaluateRequestAt evaluates a request over the files access allows.
+// Without To the window ends at now.
+func (s *rrdServer) evaluateRequestAt(req EvaluateRequest, now time.Time, access pathAccess) (EvaluateResponse, error) {
+	reduce, err := parseReducer(req.Reducer)
+	if err != nil {
+		return EvaluateResponse{}, err
+	}
+	if len(req.Conditions) == 0 {
+		return EvaluateResponse{}, errors.New("no conditions")
+	}
+	for _, c := range req.Conditions {
+		if _, err := compare(c.Op, 0, c.Value); err != nil {
+			return EvaluateResponse{}, err
+		}
+	}
+
+	window, err := parseOptionalDuration(req.Window, defaultEvaluateWindow)
+	if err != nil || window == 0 {
+		return EvaluateResponse{}, fmt.Errorf("invalid window %q", req.Window)
+	}
+	to := now
+	if req.To != "" {
+		if to, err = time.Parse(time.RFC3339Nano, req.To); err != nil {
+			return EvaluateResponse{}, fmt.Errorf("invalid time %q", req.To)
+		}
+	}
+	from := to.Add(-window)
+
+	fetch := fetchWindow{From: from, To: to, Step: s.queryStep(QueryRequest{}, from, to)}
+	targetSeries, err := s.evalTargets([]QueryTarget{{Target: req.Target, CF: req.CF, RefID: "A"}}, fetch, access)
+	if err != nil {
+		return EvaluateResponse{}, err
+	}
+
+	result := EvaluateResponse{State: stateOK, Series: make([]EvaluateSeries, 0, len(targetSeries[0]))}
+	if len(targetSeries[0]) == 0 {
+		result.State = stateNoData
+	}
+	for _, series := range targetSeries[0] {
+		values := make([]float64, len(series.DataPoints))
+		for i, p := range series.DataPoints {
+			values[i] = p[0]
+		}
+
+		evaluated := EvaluateSeries{Target: series.Target, State: stateNoData}
+		if value := reduce(values); !math.IsNaN(value) {
+			evaluated.Value = &value
+			evaluated.State = stateOK
+			for _, c := range req.Conditions {
+				if holds, _ := compare(c.Op, value, c.Value); holds {
+					evaluated.State = stateAlerting
+					break
+				}
+			}
+		}
+		result.Series = append(result.Series, evaluated)
+
+		switch {
+		case evaluated.State == stateAlerting:
+			result.State = stateAlerting
+		case evaluated.State == stateNoData && result.State == stateOK:
+			result.State = stateNoData
+		}
+	}
+	return result, nil
+}
+
+// parseReducer returns the function reducing a series to one value: last,
+// avg, min, max, or a percentile such as p95 or p99.9. The default is last.
+// Reducers return NaN for series without values.
+func parseReducer(name string) (func([]float64) float64, error) {
+	switch name {
+	case "", "last":
+		return func(values []float64) float64 { return consolidate(values, "LAST") }, nil
+	case "avg":
+		return func(values []float64) float64 { return consolidate(values, "AVERAGE") }, nil
+	case "min":
+		return func(values []float64) float64 { return consolidate(values, "MIN") }, nil
+	case "max":
+		return func(values []float64) float64 { return consolidate(values, "MAX") }, nil
+	}
+
+	if strings.HasPrefix(name, "p") {
+		p, err := strconv.ParseFloat(name[1:], 64)
+		if err == nil && p > 0 && p <= 100 {
+			return func(values []float64) float64 { return percentile(values, p) }, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown reducer %q", name)
+}
+
+// percentile returns the nearest-rank percentile of the values
+func percentile(values []float64, p float64) float64 {
+	sorted := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sorted = append(sorted, v)
+		}
+	}
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// compare applies a condition operator
+func compare(op string, value, threshold float64) (bool, error) {
+	switch op {
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case "==":
+		return value == threshold, nil
+	case "!=":
+		return value != threshold, nil
+	}
+	return false, fmt.Errorf("unknown operator %q", op)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	s := sampleServer(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.evaluate))
+	defer ts.Close()
+
+	post := func(body string) (int, EvaluateResponse) {
+		r, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error at an POST request. %v", err)
+		}
+		var res EvaluateResponse
+		json.NewDecoder(r.Body).Decode(&res)
+		return r.StatusCode, res
+	}
+
+	// percent-idle and percent-user are between 0 and 100
+	status, res := post(`{"target":"percent:percent-*:value","window":"30m","to":"2016-12-08T02:00:00Z",
+	  "reducer":"max","conditions":[{"op":">","value":-1}]}`)
+	if status != http.StatusOK || res.State != stateAlerting || len(res.Series) != 2 {
+		t.Fatalf("Every series should be alerting. %d %+v", status, res)
+	}
+	for _, s := range res.Series {
+		if s.State != stateAlerting || s.Value == nil {
+			t.Fatalf("Unexpected series. %+v", s)
+		}
+	}
+
+	_, res = post(`{"target":"percent:percent-idle:value","window":"30m","to":"2016-12-08T02:00:00Z",
+	  "reducer":"p50","conditions":[{"op":">","value":100},{"op":"<","value":0}]}`)
+	if res.State != stateOK || res.Series[0].State != stateOK {
+		t.Fatalf("Values within the thresholds should be ok. %+v", res)
+	}
+
+	// The sample files have no data years later
+	_, res = post(`{"target":"percent:percent-idle:value","window":"5m","to":"2020-01-01T00:00:00Z",
+	  "conditions":[{"op":">","value":0}]}`)
+	if res.State != stateNoData || res.Series[0].Value != nil {
+		t.Fatalf("Series without points should be nodata. %+v", res)
+	}
+	_, res = post(`{"target":"percent:nothing:value","conditions":[{"op":">","value":0}]}`)
+	if res.State != stateNoData || len(res.Series) != 0 {
+		t.Fatalf("Targets without files should be nodata. %+v", res)
+	}
+
+	for _, body := range []string{
+		`{"target":"percent:percent-idle:value","conditions":[]}`,
+		`{"target":"percent:percent-idle:value","reducer":"median","conditions":[{"op":">","value":0}]}`,
+		`{"target":"percent:percent-idle:value","conditions":[{"op":"=>","value":0}]}`,
+		`{"target":"percent:percent-idle:value","window":"-5m","conditions":[{"op":">","value":0}]}`,
+	} {
+		if status, _ := post(body); status != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %s but %d.", body, status)
+		}
+	}
+}
+
+func TestParseReducer(t *testing.T) {
+	values := []float64{4, math.NaN(), 1, 3, 2, 5, 6, 7, 8, 9, 10}
+	for name, expected := range map[string]float64{
+		"":     10,
+		"last": 10,
+		"avg":  5.5,
+		"min":  1,
+		"max":  10,
+		"p50":  5,
+		"p90":  9,
+		"p100": 10,
+	} {
+		reduce, err := parseReducer(name)
+		if err != nil {
+			t.Fatalf("Cannot parse reducer %q. %v", name, err)
+		}
+		if v := reduce(values); v != expected {
+			t.Fatalf("Reducer %q should give %v but %v.", name, expected, v)
+		}
+	}
+	for _, name := range []string{"p0", "p101", "px", "median"} {
+		if _, err := parseReducer(name); err == nil {
+			t.Fatalf("Reducer %q should be rejected.", name)
+		}
+	}
+	if reduce, _ := parseReducer("p95"); !math.IsNaN(reduce(nil)) {
+		t.Fatal("Reducing no values should give NaN.")
+	}
+}
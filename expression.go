@@ -0,0 +1,439 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression targets compute new series from other series inside the
+// server. Two notations are accepted:
+//
+//   - infix, with operators separated by spaces so they can't be confused
+//     with wildcards and dashes in paths: "sum(*:port-*:traffic_in) * 8"
+//   - RPN like rrdtool's CDEF: "A,B,+,8,*"
+//
+// Operands are numbers, targets ("host:port-eth0:traffic_in@MAX") or the
+// refId of another target in the same request.
+
+// exprFunctions aggregate all series of their argument into one series
+var exprFunctions = map[string]string{
+	"sum": "SUM",
+	"avg": "AVERAGE",
+	"min": "MIN",
+	"max": "MAX",
+}
+
+// rpnOperators maps the CDEF operators to the ones used by applyOp
+var rpnOperators = map[string]string{
+	"+":   "+",
+	"-":   "-",
+	"*":   "*",
+	"/":   "/",
+	"MIN": "MIN",
+	"MAX": "MAX",
+}
+
+type exprValue struct {
+	series   []QueryResponse
+	scalar   float64
+	isScalar bool
+}
+
+// exprEnv resolves expression operands
+type exprEnv struct {
+	server *rrdServer
+	refs   map[string][]QueryResponse
+	window fetchWindow
+	access pathAccess
+}
+
+// isExpression reports whether a target has to be evaluated as an expression
+// rather than fetched as a path. Commas of {a,b} alternatives belong to the
+// path.
+func isExpression(target string) bool {
+	return strings.ContainsAny(stripBraces(target), "(), \t")
+}
+
+// stripBraces removes the {a,b} alternatives of the paths in an expression
+func stripBraces(s string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range s {
+		switch {
+		case r == '{':
+			depth++
+		case r == '}' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// evalExpression evaluates an expression target. A result made of a single
+// series is named after the expression, otherwise the series keep the names
+// of the targets they were computed from.
+func evalExpression(expr string, env *exprEnv) ([]QueryResponse, error) {
+	var v exprValue
+	var err error
+	if stripped := stripBraces(expr); strings.Contains(stripped, ",") && !strings.Contains(stripped, "(") {
+		v, err = env.evalRPN(expr)
+	} else {
+		v, err = env.evalInfix(expr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v.isScalar {
+		return nil, fmt.Errorf("expression %q doesn't reference any series", expr)
+	}
+
+	if len(v.series) == 1 {
+		v.series[0].Target = expr
+	}
+	return v.series, nil
+}
+
+func (env *exprEnv) operand(token string) (exprValue, error) {
+	if f, err := strconv.ParseFloat(token, 64); err == nil {
+		return exprValue{scalar: f, isScalar: true}, nil
+	}
+
+	if series, ok := env.refs[token]; ok {
+		copied := make([]QueryResponse, len(series))
+		copy(copied, series)
+		return exprValue{series: copied}, nil
+	}
+
+	targetPath, cf := splitTargetCF(token)
+	if !strings.Contains(targetPath, ":") {
+		return exprValue{}, fmt.Errorf("unknown reference %q", token)
+	}
+	if cf != "" && !hasCF(consolidationFunctions, cf) {
+		return exprValue{}, fmt.Errorf("unknown consolidation function %q", cf)
+	}
+
+	jobs, err := env.server.expandTarget(targetPath, cf, env.access)
+	if err != nil {
+		return exprValue{}, err
+	}
+	return exprValue{series: compactSeries(env.server.fetchAllSeries(jobs, env.window))}, nil
+}
+
+func (env *exprEnv) evalRPN(expr string) (exprValue, error) {
+	var stack []exprValue
+	for _, token := range splitArgs(expr) {
+		if op, ok := rpnOperators[strings.ToUpper(token)]; ok {
+			if len(stack) < 2 {
+				return exprValue{}, fmt.Errorf("operator %q needs two operands", token)
+			}
+			a, b := stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+			v, err := applyOp(op, a, b)
+			if err != nil {
+				return exprValue{}, err
+			}
+			stack = append(stack, v)
+			continue
+		}
+
+		v, err := env.operand(token)
+		if err != nil {
+			return exprValue{}, err
+		}
+		stack = append(stack, v)
+	}
+
+	if len(stack) != 1 {
+		return exprValue{}, fmt.Errorf("expression %q leaves %d values on the stack", expr, len(stack))
+	}
+	return stack[0], nil
+}
+
+// infixParser is a recursive descent parser for
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = "(" expr ")" | function "(" expr ")" | operand
+type infixParser struct {
+	env    *exprEnv
+	tokens []string
+	pos    int
+}
+
+func (env *exprEnv) evalInfix(expr string) (exprValue, error) {
+	p := &infixParser{env: env, tokens: tokenizeInfix(expr)}
+	v, err := p.expr()
+	if err != nil {
+		return exprValue{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return exprValue{}, fmt.Errorf("unexpected %q in expression", p.tokens[p.pos])
+	}
+	return v, nil
+}
+
+// tokenizeInfix splits on whitespace and around parentheses and commas,
+// except within the {a,b} alternatives of a path
+func tokenizeInfix(expr string) []string {
+	var tokens []string
+	var cur strings.Builder
+	depth := 0
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, r := range expr {
+		switch {
+		case r == '{' || (r == '}' && depth > 0):
+			if r == '{' {
+				depth++
+			} else {
+				depth--
+			}
+			cur.WriteRune(r)
+		case depth > 0:
+			cur.WriteRune(r)
+		case unicode.IsSpace(r):
+			flush()
+		case r == '(' || r == ')' || r == ',':
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+func (p *infixParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *infixParser) expr() (exprValue, error) {
+	v, err := p.term()
+	if err != nil {
+		return exprValue{}, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.tokens[p.pos]
+		p.pos++
+		rhs, err := p.term()
+		if err != nil {
+			return exprValue{}, err
+		}
+		if v, err = applyOp(op, v, rhs); err != nil {
+			return exprValue{}, err
+		}
+	}
+	return v, nil
+}
+
+func (p *infixParser) term() (exprValue, error) {
+	v, err := p.factor()
+	if err != nil {
+		return exprValue{}, err
+	}
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.tokens[p.pos]
+		p.pos++
+		rhs, err := p.factor()
+		if err != nil {
+			return exprValue{}, err
+		}
+		if v, err = applyOp(op, v, rhs); err != nil {
+			return exprValue{}, err
+		}
+	}
+	return v, nil
+}
+
+func (p *infixParser) factor() (exprValue, error) {
+	token := p.peek()
+	switch token {
+	case "":
+		return exprValue{}, fmt.Errorf("unexpected end of expression")
+	case ")", ",", "+", "-", "*", "/":
+		return exprValue{}, fmt.Errorf("unexpected %q in expression", token)
+	}
+	p.pos++
+
+	if token == "(" {
+		v, err := p.expr()
+		if err != nil {
+			return exprValue{}, err
+		}
+		if err := p.expect(")"); err != nil {
+			return exprValue{}, err
+		}
+		return v, nil
+	}
+
+	if cf, ok := exprFunctions[strings.ToLower(token)]; ok && p.peek() == "(" {
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return exprValue{}, err
+		}
+		if err := p.expect(")"); err != nil {
+			return exprValue{}, err
+		}
+		if v.isScalar {
+			return v, nil
+		}
+		return exprValue{series: []QueryResponse{aggregateSeries(token, v.series, cf)}}, nil
+	}
+
+	return p.env.operand(token)
+}
+
+func (p *infixParser) expect(token string) error {
+	if p.peek() != token {
+		return fmt.Errorf("expected %q in expression", token)
+	}
+	p.pos++
+	return nil
+}
+
+// applyOp applies a binary operator to two values. A series set combined
+// with a scalar or a single series is broadcast, two series sets of the
+// same size are combined pairwise.
+func applyOp(op string, a, b exprValue) (exprValue, error) {
+	if a.isScalar && b.isScalar {
+		return exprValue{scalar: calc(op, a.scalar, b.scalar), isScalar: true}, nil
+	}
+
+	if b.isScalar {
+		result := make([]QueryResponse, len(a.series))
+		for i, s := range a.series {
+			result[i] = mapSeries(s, func(v float64) float64 { return calc(op, v, b.scalar) })
+		}
+		return exprValue{series: result}, nil
+	}
+	if a.isScalar {
+		result := make([]QueryResponse, len(b.series))
+		for i, s := range b.series {
+			result[i] = mapSeries(s, func(v float64) float64 { return calc(op, a.scalar, v) })
+		}
+		return exprValue{series: result}, nil
+	}
+
+	switch {
+	case len(a.series) == len(b.series):
+		result := make([]QueryResponse, len(a.series))
+		for i := range a.series {
+			result[i] = joinSeries(op, a.series[i], b.series[i], a.series[i].Target)
+		}
+		return exprValue{series: result}, nil
+	case len(a.series) == 1:
+		result := make([]QueryResponse, len(b.series))
+		for i := range b.series {
+			result[i] = joinSeries(op, a.series[0], b.series[i], b.series[i].Target)
+		}
+		return exprValue{series: result}, nil
+	case len(b.series) == 1:
+		result := make([]QueryResponse, len(a.series))
+		for i := range a.series {
+			result[i] = joinSeries(op, a.series[i], b.series[0], a.series[i].Target)
+		}
+		return exprValue{series: result}, nil
+	}
+	return exprValue{}, fmt.Errorf("cannot apply %q to %d and %d series", op, len(a.series), len(b.series))
+}
+
+func calc(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "MIN":
+		return math.Min(a, b)
+	case "MAX":
+		return math.Max(a, b)
+	}
+	return math.NaN()
+}
+
+// validPoint reports whether a value can be returned; JSON has no NaN or Inf
+func validPoint(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func mapSeries(s QueryResponse, f func(float64) float64) QueryResponse {
+	points := make([][]float64, 0, len(s.DataPoints))
+	for _, p := range s.DataPoints {
+		if v := f(p[0]); validPoint(v) {
+			points = append(points, []float64{v, p[1]})
+		}
+	}
+	return QueryResponse{Target: s.Target, DataPoints: points}
+}
+
+// joinSeries combines the points of a and b that share a timestamp
+func joinSeries(op string, a, b QueryResponse, target string) QueryResponse {
+	bValues := make(map[float64]float64, len(b.DataPoints))
+	for _, p := range b.DataPoints {
+		bValues[p[1]] = p[0]
+	}
+
+	points := make([][]float64, 0, len(a.DataPoints))
+	for _, p := range a.DataPoints {
+		bv, ok := bValues[p[1]]
+		if !ok {
+			continue
+		}
+		if v := calc(op, p[0], bv); validPoint(v) {
+			points = append(points, []float64{v, p[1]})
+		}
+	}
+	return QueryResponse{Target: target, DataPoints: points}
+}
+
+// aggregateSeries merges series into one, consolidating the values found at
+// each timestamp with cf ("SUM" or one of the RRD consolidation functions)
+func aggregateSeries(target string, series []QueryResponse, cf string) QueryResponse {
+	values := map[float64][]float64{}
+	for _, s := range series {
+		for _, p := range s.DataPoints {
+			values[p[1]] = append(values[p[1]], p[0])
+		}
+	}
+
+	timestamps := make([]float64, 0, len(values))
+	for ts := range values {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Float64s(timestamps)
+
+	points := make([][]float64, 0, len(timestamps))
+	for _, ts := range timestamps {
+		var v float64
+		if cf == "SUM" {
+			for _, x := range values[ts] {
+				v += x
+			}
+		} else {
+			v = consolidate(values[ts], cf)
+		}
+		if validPoint(v) {
+			points = append(points, []float64{v, ts})
+		}
+	}
+	return QueryResponse{Target: target, DataPoints: points}
+}
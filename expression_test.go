@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEvalExpression(t *testing.T) {
+	env := &exprEnv{refs: map[string][]QueryResponse{
+		"A": {{Target: "a", DataPoints: [][]float64{{1, 1000}, {2, 2000}, {3, 3000}}}},
+		"B": {{Target: "b", DataPoints: [][]float64{{10, 1000}, {20, 2000}}}},
+		"C": {
+			{Target: "c1", DataPoints: [][]float64{{1, 1000}, {2, 2000}}},
+			{Target: "c2", DataPoints: [][]float64{{3, 1000}, {4, 3000}}},
+		},
+	}}
+
+	tests := []struct {
+		expr     string
+		expected [][]float64
+	}{
+		{"A,B,+,8,*", [][]float64{{88, 1000}, {176, 2000}}},
+		{"A,B,MAX", [][]float64{{10, 1000}, {20, 2000}}},
+		{"(A + B) * 8", [][]float64{{88, 1000}, {176, 2000}}},
+		{"A * 2 + 1", [][]float64{{3, 1000}, {5, 2000}, {7, 3000}}},
+		{"sum(C)", [][]float64{{4, 1000}, {2, 2000}, {4, 3000}}},
+		{"max(C) / 2", [][]float64{{1.5, 1000}, {1, 2000}, {2, 3000}}},
+		{"A / 0", [][]float64{}},
+	}
+
+	for _, test := range tests {
+		series, err := evalExpression(test.expr, env)
+		if err != nil {
+			t.Fatalf("Cannot evaluate %q. %v", test.expr, err)
+		}
+		if len(series) != 1 {
+			t.Fatalf("Expected one series for %q but got %d.", test.expr, len(series))
+		}
+		if series[0].Target != test.expr {
+			t.Fatalf("Series of %q is named %q.", test.expr, series[0].Target)
+		}
+		got, _ := json.Marshal(series[0].DataPoints)
+		expected, _ := json.Marshal(test.expected)
+		if string(got) != string(expected) {
+			t.Fatalf("%q evaluated to %s instead of %s.", test.expr, got, expected)
+		}
+	}
+
+	series, err := evalExpression("C * 8", env)
+	if err != nil {
+		t.Fatalf("Cannot evaluate C * 8. %v", err)
+	}
+	if len(series) != 2 || series[0].Target != "c1" || series[1].Target != "c2" {
+		t.Fatalf("Series of a set should keep their names. %v", series)
+	}
+
+	for _, expr := range []string{"A,+", "A B", "sum(A", "A + ", "unknown + 1", "1 + 2"} {
+		if _, err := evalExpression(expr, env); err == nil {
+			t.Fatalf("Expected an error for %q.", expr)
+		}
+	}
+}
+
+func TestQueryExpression(t *testing.T) {
+	s := sampleServer(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.query))
+	defer ts.Close()
+
+	requestJSON := `{
+	  "range":{
+	    "from":"2016-12-07T22:47:00Z",
+	    "to":"2016-12-08T02:08:00Z"
+	  },
+	  "targets":[
+	    {"target":"percent:percent-idle:value","refId":"A","hide":true},
+	    {"target":"percent:percent-user:value","refId":"B","hide":true},
+	    {"target":"A,B,+","refId":"C"},
+	    {"target":"sum(percent:percent-*:value)","refId":"D"},
+	    {"target":"percent:percent-idle:value * 8","refId":"E"},
+	    {"target":"percent:percent-{idle,user}:value","refId":"F","hide":true},
+	    {"target":"sum(percent:percent-{idle,user}:value)","refId":"G"}
+	  ]
+	}`
+
+	r, err := http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	if r.StatusCode != 200 {
+		t.Fatalf("Status code is not 200 but %d.", r.StatusCode)
+	}
+
+	var qrs = []QueryResponse{}
+	err = json.NewDecoder(r.Body).Decode(&qrs)
+	if err != nil {
+		t.Fatalf("Error at decoding JSON response. %v", err)
+	}
+
+	series := map[string][][]float64{}
+	for _, v := range qrs {
+		series[v.Target] = v.DataPoints
+	}
+	if len(series) != 4 {
+		t.Fatalf("Hidden targets shouldn't be returned. %v", series)
+	}
+	if len(series["A,B,+"]) == 0 {
+		t.Fatal("A,B,+ isn't contained in the response.")
+	}
+	if len(series["A,B,+"]) != len(series["sum(percent:percent-*:value)"]) {
+		t.Fatal("A,B,+ and sum(percent:percent-*:value) should be the same series.")
+	}
+	for i, p := range series["A,B,+"] {
+		if p[0] != series["sum(percent:percent-*:value)"][i][0] {
+			t.Fatalf("A,B,+ and sum(percent:percent-*:value) differ at %v.", p[1])
+		}
+	}
+	if len(series["sum(percent:percent-{idle,user}:value)"]) != len(series["A,B,+"]) {
+		t.Fatal("Brace alternatives should be expanded inside expressions.")
+	}
+	if len(series["percent:percent-idle:value * 8"]) == 0 {
+		t.Fatal("percent:percent-idle:value * 8 isn't contained in the response.")
+	}
+
+	// Brace alternatives are paths, not RPN expressions
+	requestJSON = `{
+	  "range":{"from":"2016-12-07T22:47:00Z","to":"2016-12-08T02:08:00Z"},
+	  "targets":[{"target":"percent:percent-{idle,user}:value","refId":"A"}]
+	}`
+	r, err = http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+	qrs = []QueryResponse{}
+	if err := json.NewDecoder(r.Body).Decode(&qrs); err != nil || r.StatusCode != 200 {
+		t.Fatalf("Cannot query a brace glob. %d %v", r.StatusCode, err)
+	}
+	if len(qrs) != 2 || qrs[0].Target != "percent:percent-idle:value" || qrs[1].Target != "percent:percent-user:value" {
+		t.Fatalf("Expected both percent series. %v", qrs)
+	}
+
+	// Test for an invalid expression
+	requestJSON = `{"targets":[{"target":"A,+","refId":"A"}]}`
+	r, err = http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	if r.StatusCode != 400 {
+		t.Fatalf("Status code is not 400 but %d.", r.StatusCode)
+	}
+}
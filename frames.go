@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+)
+
+// Targets with "type": "frames" are returned in Grafana's data frame JSON:
+// a frame per series with columnar time and value fields. The value field
+// carries the unit from the path rules, the min and max of the RRD data
+// source and labels built from the target's path segments.
+
+// DataFrame is a frame in Grafana's data frame JSON
+type DataFrame struct {
+	Schema DataFrameSchema `json:"schema"`
+	Data   DataFrameData   `json:"data"`
+}
+
+type DataFrameSchema struct {
+	Name   string           `json:"name,omitempty"`
+	RefID  string           `json:"refId,omitempty"`
+	Fields []DataFrameField `json:"fields"`
+}
+
+type DataFrameField struct {
+	Name     string                `json:"name"`
+	Type     string                `json:"type"`
+	TypeInfo DataFrameTypeInfo     `json:"typeInfo"`
+	Labels   map[string]string     `json:"labels,omitempty"`
+	Config   *DataFrameFieldConfig `json:"config,omitempty"`
+}
+
+type DataFrameTypeInfo struct {
+	Frame    string `json:"frame"`
+	Nullable bool   `json:"nullable,omitempty"`
+}
+
+type DataFrameFieldConfig struct {
+	DisplayNameFromDS string   `json:"displayNameFromDS,omitempty"`
+	Unit              string   `json:"unit,omitempty"`
+	Min               *float64 `json:"min,omitempty"`
+	Max               *float64 `json:"max,omitempty"`
+}
+
+// DataFrameData holds the values of each field, in the order of the schema
+type DataFrameData struct {
+	Values []interface{} `json:"values"`
+}
+
+// seriesMeta describes a series read from an RRD file
+type seriesMeta struct {
+	labels map[string]string
+	unit   string
+	// min and max are NaN when the data source is unbounded
+	min float64
+	max float64
+}
+
+// frameLabels returns the labels of a "path:to:file:ds" target: the same as
+// in the Prometheus API without __name__, plus the CF if one was requested
+func frameLabels(target, cf string) map[string]string {
+	labels := promLabels(target)
+	delete(labels, "__name__")
+	if cf != "" {
+		labels["cf"] = cf
+	}
+	return labels
+}
+
+// seriesFrame converts a series to a frame
+func seriesFrame(refID string, series QueryResponse) DataFrame {
+	times := make([]int64, len(series.DataPoints))
+	values := make([]float64, len(series.DataPoints))
+	for i, p := range series.DataPoints {
+		values[i] = p[0]
+		times[i] = int64(p[1])
+	}
+
+	valueField := DataFrameField{
+		Name:     "Value",
+		Type:     "number",
+		TypeInfo: DataFrameTypeInfo{Frame: "float64"},
+		Config:   &DataFrameFieldConfig{DisplayNameFromDS: series.Target},
+	}
+	if meta := series.meta; meta != nil {
+		valueField.Labels = meta.labels
+		valueField.Config.Unit = meta.unit
+		if !math.IsNaN(meta.min) {
+			valueField.Config.Min = &meta.min
+		}
+		if !math.IsNaN(meta.max) {
+			valueField.Config.Max = &meta.max
+		}
+	}
+
+	return DataFrame{
+		Schema: DataFrameSchema{
+			Name:  series.Target,
+			RefID: refID,
+			Fields: []DataFrameField{
+				{Name: "Time", Type: "time", TypeInfo: DataFrameTypeInfo{Frame: "time.Time"}},
+				valueField,
+			},
+		},
+		Data: DataFrameData{Values: []interface{}{times, values}},
+	}
+}
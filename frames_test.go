@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQueryFrames(t *testing.T) {
+	config := sampleConfig()
+	config.Paths = []PathConfig{{Match: "percent:*", Unit: "percent"}}
+	s := newTestServer(t, config)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.query))
+	defer ts.Close()
+
+	requestJSON := `{
+	  "range":{
+	    "from":"2016-12-07T22:47:00Z",
+	    "to":"2016-12-08T02:08:00Z"
+	  },
+	  "format":"frames",
+	  "targets":[
+	    {"target":"percent:percent-idle:value","refId":"A"},
+	    {"target":"percent:percent-user:value","refId":"B","type":"timeserie"}
+	  ]
+	}`
+
+	r, err := http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	var response []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		t.Fatalf("Error at decoding JSON response. %v", err)
+	}
+	if len(response) != 2 {
+		t.Fatalf("Expected a frame and a series. %s", response)
+	}
+
+	var frame struct {
+		Schema DataFrameSchema `json:"schema"`
+		Data   struct {
+			Values [2][]float64 `json:"values"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(response[0], &frame); err != nil {
+		t.Fatalf("Error at decoding the frame. %v", err)
+	}
+	if frame.Schema.RefID != "A" || len(frame.Schema.Fields) != 2 || frame.Schema.Fields[0].Type != "time" {
+		t.Fatalf("Unexpected schema. %+v", frame.Schema)
+	}
+	times, values := frame.Data.Values[0], frame.Data.Values[1]
+	if len(times) == 0 || len(times) != len(values) {
+		t.Fatalf("Expected as many times as values. %d %d", len(times), len(values))
+	}
+
+	field := frame.Schema.Fields[1]
+	if field.Config == nil || field.Config.Unit != "percent" || field.Config.DisplayNameFromDS != "percent:percent-idle:value" {
+		t.Fatalf("Unexpected field config. %+v", field.Config)
+	}
+	if field.Labels["dir1"] != "percent" || field.Labels["file"] != "percent-idle" || field.Labels["ds"] != "value" {
+		t.Fatalf("Labels should come from the path. %v", field.Labels)
+	}
+
+	var series QueryResponse
+	if err := json.Unmarshal(response[1], &series); err != nil || len(series.DataPoints) == 0 {
+		t.Fatalf("A target with its own type should keep it. %s", response[1])
+	}
+}
+
+func TestSeriesFrame(t *testing.T) {
+	series := QueryResponse{
+		Target:     "host:if:traffic_in",
+		DataPoints: [][]float64{{1, 1000}, {2, 2000}},
+		meta:       &seriesMeta{labels: frameLabels("host:if:traffic_in", "MAX"), min: 0, max: math.NaN()},
+	}
+	frame := seriesFrame("A", series)
+
+	field := frame.Schema.Fields[1]
+	if field.Config.Min == nil || *field.Config.Min != 0 || field.Config.Max != nil {
+		t.Fatalf("Only bounded limits should be set. %+v", field.Config)
+	}
+	if field.Labels["cf"] != "MAX" || field.Labels["path"] != "host:if" {
+		t.Fatalf("Unexpected labels. %v", field.Labels)
+	}
+	if times := frame.Data.Values[0].([]int64); times[1] != 2000 {
+		t.Fatalf("Times should be in milliseconds. %v", times)
+	}
+
+	// Expression results have no metadata
+	frame = seriesFrame("B", QueryResponse{Target: "sum(A)"})
+	if frame.Schema.Fields[1].Labels != nil || frame.Schema.Fields[1].Config.Unit != "" {
+		t.Fatalf("Unexpected field. %+v", frame.Schema.Fields[1])
+	}
+}
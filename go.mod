@@ -3,9 +3,26 @@ module github.com/doublemarket/grafana-rrd-server
 go 1.23
 
 require (
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/gocarina/gocsv v0.0.0-20240520201108-78e41c74b4b1
+	github.com/mattn/go-sqlite3 v1.14.28
 	github.com/mattn/go-zglob v0.0.6
+	github.com/prometheus/client_golang v1.22.0
 	github.com/ziutek/rrd v0.0.4
+	golang.org/x/crypto v0.32.0
+	golang.org/x/sys v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/multiplay/go-rrd v0.0.0-20171201124026-4a70b1d94ccb // indirect
+require github.com/multiplay/go-rrd v0.0.0-20171201124026-4a70b1d94ccb
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.62.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	google.golang.org/protobuf v1.36.5 // indirect
+)
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// InfoResponse is the header of an RRD file as returned by /info. Times are
+// in milliseconds and steps and spans in seconds.
+type InfoResponse struct {
+	Target      string           `json:"target"`
+	Step        int64            `json:"step"`
+	LastUpdate  int64            `json:"lastUpdate"`
+	DataSources []InfoDataSource `json:"dataSources"`
+	RRAs        []InfoArchive    `json:"rras"`
+}
+
+// InfoDataSource is a DS definition. Min and Max are null for "U".
+type InfoDataSource struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Heartbeat int      `json:"heartbeat"`
+	Min       *float64 `json:"min"`
+	Max       *float64 `json:"max"`
+}
+
+// InfoArchive is an RRA definition. Step is the time a row covers and Span
+// the time the whole archive covers, which ends at the last update.
+type InfoArchive struct {
+	CF        string  `json:"cf"`
+	Rows      int     `json:"rows"`
+	PdpPerRow int     `json:"pdpPerRow"`
+	XFF       float64 `json:"xff"`
+	Step      int64   `json:"step"`
+	Span      int64   `json:"span"`
+	From      int64   `json:"from"`
+}
+
+// info serves the header of the RRD file of a "path:to:file" target. A
+// "path:to:file:ds" target as used in queries is accepted too.
+func (s *rrdServer) info(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,HEAD,OPTIONS")
+		w.Write(nil)
+		return
+	}
+
+	searchRequest := SearchRequest{Target: r.URL.Query().Get("target")}
+	if r.Body != nil {
+		decoder := json.NewDecoder(r.Body)
+		err := decoder.Decode(&searchRequest)
+		if err != nil && err.Error() != "EOF" {
+			logger.Error("Cannot decode info request", "error", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+	}
+
+	target, _ := splitTargetCF(searchRequest.Target)
+	if err := checkFileTarget(target); err != nil {
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+		return
+	}
+	root, filePath := s.infoFile(target)
+	// Files the user can't read are reported missing, so their names aren't
+	// revealed either
+	if root == nil || !s.accessFor(r).allows(root.target(filePath)) {
+		respondJSONStatus(w, http.StatusNotFound, ErrorResponse{Message: "No RRD file for target " + searchRequest.Target})
+		return
+	}
+
+	header, err := root.rrdInfo(filePath)
+	if err != nil {
+		logger.Error("Cannot retrieve information from RRD file", "path", filePath, "error", err)
+		respondJSONStatus(w, http.StatusInternalServerError, ErrorResponse{Message: "Cannot read the RRD file"})
+		return
+	}
+	respondJSON(w, infoResponse(root.target(filePath), header))
+}
+
+// infoFile returns the root and RRD file of a target, dropping a trailing
+// DS name if the target doesn't name a file itself
+func (s *rrdServer) infoFile(target string) (*rrdRoot, string) {
+	candidates := []string{target}
+	if i := strings.LastIndex(target, ":"); i > 0 {
+		candidates = append(candidates, target[:i])
+	}
+	for _, fileTarget := range candidates {
+		root, filePath := s.roots.fileForTarget(fileTarget)
+		if root == nil {
+			continue
+		}
+		if stat, err := os.Stat(filePath); err == nil && stat.Mode().IsRegular() && root.contains(filePath) && s.roots.owns(root, filePath) {
+			return root, filePath
+		}
+	}
+	return nil, ""
+}
+
+func infoResponse(target string, header *RRDInfo) InfoResponse {
+	step := int64(header.Step.Seconds())
+	result := InfoResponse{
+		Target:      target,
+		Step:        step,
+		LastUpdate:  header.LastUpdate.UnixMilli(),
+		DataSources: make([]InfoDataSource, 0, len(header.DataSources)),
+		RRAs:        make([]InfoArchive, 0, len(header.RRAs)),
+	}
+
+	bound := func(value float64) *float64 {
+		if math.IsNaN(value) {
+			return nil
+		}
+		return &value
+	}
+	for name, ds := range header.DataSources {
+		result.DataSources = append(result.DataSources, InfoDataSource{
+			Name:      name,
+			Type:      ds.Type,
+			Heartbeat: ds.Heartbeat,
+			Min:       bound(ds.Min),
+			Max:       bound(ds.Max),
+		})
+	}
+	sort.Slice(result.DataSources, func(i, j int) bool {
+		return header.DsIndex[result.DataSources[i].Name] < header.DsIndex[result.DataSources[j].Name]
+	})
+
+	for _, rra := range header.RRAs {
+		rowStep := step * int64(rra.PdpPerRow)
+		span := rowStep * int64(rra.Rows)
+		result.RRAs = append(result.RRAs, InfoArchive{
+			CF:        rra.CF,
+			Rows:      rra.Rows,
+			PdpPerRow: rra.PdpPerRow,
+			XFF:       rra.XFF,
+			Step:      rowStep,
+			Span:      span,
+			From:      header.LastUpdate.UnixMilli() - span*1000,
+		})
+	}
+	return result
+}
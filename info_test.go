@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	s := sampleServer(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.info))
+	defer ts.Close()
+
+	for _, target := range []string{"percent:percent-idle", "percent:percent-idle:value@MAX"} {
+		r, err := http.Post(ts.URL, "application/json", strings.NewReader(`{"target":"`+target+`"}`))
+		if err != nil {
+			t.Fatalf("Error at an POST request. %v", err)
+		}
+		var res InfoResponse
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			t.Fatalf("Error at decoding JSON response. %v", err)
+		}
+
+		if res.Target != "percent:percent-idle" || res.Step <= 0 || res.LastUpdate <= 0 {
+			t.Fatalf("Unexpected header for %s. %+v", target, res)
+		}
+		if len(res.DataSources) != 1 || res.DataSources[0].Name != "value" || res.DataSources[0].Type == "" {
+			t.Fatalf("Unexpected data sources. %+v", res.DataSources)
+		}
+		if len(res.RRAs) == 0 {
+			t.Fatal("Expected RRAs.")
+		}
+		for _, rra := range res.RRAs {
+			if rra.CF == "" || rra.Step != res.Step*int64(rra.PdpPerRow) || rra.Span != rra.Step*int64(rra.Rows) {
+				t.Fatalf("Unexpected RRA. %+v", rra)
+			}
+			if rra.From != res.LastUpdate-rra.Span*1000 {
+				t.Fatalf("The archive should end at the last update. %+v", rra)
+			}
+		}
+	}
+
+	r, err := http.Get(ts.URL + "?target=percent:nothing")
+	if err != nil {
+		t.Fatalf("Error by http.Get(). %v", err)
+	}
+	if r.StatusCode != http.StatusNotFound {
+		t.Fatalf("Unknown targets should be 404 but %d.", r.StatusCode)
+	}
+}
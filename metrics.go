@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics of the server, served by /metrics along with the Go runtime and
+// process metrics of the default registry. Labels never contain targets or
+// file paths, which would make too many series and reveal the RRD tree.
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rrdserver_http_requests_total",
+		Help: "HTTP requests by handler, method and status code.",
+	}, []string{"handler", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rrdserver_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests by handler.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"handler"})
+
+	fetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rrdserver_fetch_duration_seconds",
+		Help:    "Time taken to fetch an RRD file, by backend (rrdcached or direct).",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"backend"})
+	fetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rrdserver_fetch_errors_total",
+		Help: "RRD fetches that failed, by backend (rrdcached or direct).",
+	}, []string{"backend"})
+
+	rrdcachedRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rrdserver_rrdcached_fetch_retries_total",
+		Help: "rrdcached fetches retried after an error, by daemon.",
+	}, []string{"daemon"})
+	rrdcachedReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rrdserver_rrdcached_reconnects_total",
+		Help: "Reconnections to rrdcached after a timeout or connection error, by daemon and result (ok or error).",
+	}, []string{"daemon", "result"})
+
+	searchCacheFiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rrdserver_search_cache_files",
+		Help: "RRD files in the search cache.",
+	})
+	searchCacheUpdateDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rrdserver_search_cache_last_update_duration_seconds",
+		Help: "Time taken by the last full rescan of the roots.",
+	})
+	searchCacheLastUpdate = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rrdserver_search_cache_last_update_timestamp_seconds",
+		Help: "Time the last full rescan of the roots finished.",
+	})
+
+	globExpansions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rrdserver_glob_expansions_total",
+		Help: "Query targets expanded to RRD files, by result (ok or rejected).",
+	}, []string{"result"})
+	globMatchedFiles = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "rrdserver_glob_matched_files",
+		Help:    "RRD files matched by an expanded query target.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	})
+)
+
+// instrument counts the requests of a handler and measures their duration
+func instrument(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+		// Clients choose the method, so unknown ones share a label value
+		method := r.Method
+		switch method {
+		case "GET", "HEAD", "POST", "DELETE", "OPTIONS":
+		default:
+			method = "other"
+		}
+		httpRequests.WithLabelValues(name, method, strconv.Itoa(sw.status)).Inc()
+		httpRequestDuration.WithLabelValues(name).Observe(time.Since(started).Seconds())
+	}
+}
+
+// statusWriter records the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// observeFetch records a fetch of an RRD file that started at started
+func observeFetch(backend string, started time.Time, err error) {
+	fetchDuration.WithLabelValues(backend).Observe(time.Since(started).Seconds())
+	if err != nil {
+		fetchErrors.WithLabelValues(backend).Inc()
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+var metricsHandler = promhttp.Handler().ServeHTTP
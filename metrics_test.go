@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	s := sampleServer(t)
+
+	mux := http.NewServeMux()
+	s.registerHandlers(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	if _, err := http.Post(ts.URL+"/ls", "application/json", strings.NewReader(`{}`)); err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+	body := `{"range":{"from":"2016-12-07T22:47:00Z","to":"2016-12-08T02:08:00Z"},"targets":[{"target":"percent:*:value","refId":"A"}]}`
+	if _, err := http.Post(ts.URL+"/query", "application/json", strings.NewReader(body)); err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	r, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Error by http.Get(). %v", err)
+	}
+	defer r.Body.Close()
+	metrics, _ := io.ReadAll(r.Body)
+	for _, expected := range []string{
+		`rrdserver_http_requests_total{code="200",handler="/ls",method="POST"}`,
+		`rrdserver_http_request_duration_seconds_count{handler="/query"}`,
+		`rrdserver_fetch_duration_seconds_count{backend="direct"}`,
+		`rrdserver_glob_expansions_total{result="ok"}`,
+		`rrdserver_glob_matched_files_count`,
+		`rrdserver_search_cache_files`,
+		`rrdserver_search_cache_last_update_duration_seconds`,
+	} {
+		if !strings.Contains(string(metrics), expected) {
+			t.Fatalf("%s isn't contained in the metrics.", expected)
+		}
+	}
+}
+
+func TestSearchCacheFilesMetric(t *testing.T) {
+	dir := t.TempDir()
+	config := sampleConfig()
+	config.Roots = []RootConfig{{Name: "tmp", Path: dir}}
+	s := newTestServer(t, config)
+	root := s.roots[0]
+
+	sub := filepath.Join(dir, "host")
+	os.Mkdir(sub, 0755)
+	filePath := filepath.Join(sub, "percent-idle.rrd")
+	copyFile(t, "./sample/percent/percent-idle.rrd", filePath)
+	s.searchCache.UpdateFile(root, filePath)
+	if files := testutil.ToFloat64(searchCacheFiles); files != 1 {
+		t.Fatalf("A new file should be counted. %v", files)
+	}
+
+	s.searchCache.RemoveDir(root, sub)
+	if files := testutil.ToFloat64(searchCacheFiles); files != 0 {
+		t.Fatalf("Files of a removed directory shouldn't be counted. %v", files)
+	}
+}
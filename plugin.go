@@ -0,0 +1,292 @@
+//go:build grafanaplugin
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/grpcplugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Built with -tags grafanaplugin, the binary can also run as a Grafana
+// backend datasource plugin. Grafana starts it with the plugin handshake
+// environment set; the binary then serves QueryData, CallResource (the HTTP
+// API, e.g. /search and /ls for the query editor) and CheckHealth over the
+// plugin protocol instead of listening on a port.
+
+const pluginID = "doublemarket-rrd-datasource"
+
+func init() {
+	runAsPlugin = servePlugin
+}
+
+func servePlugin() bool {
+	if os.Getenv(grpcplugin.MagicCookieKey) != grpcplugin.MagicCookieValue {
+		return false
+	}
+
+	// stdout carries the plugin handshake, so logs go to stderr, which
+	// Grafana adds to its own log
+	logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	if err := datasource.Manage(pluginID, newPluginDatasource, datasource.ManageOpts{}); err != nil {
+		logger.Error("Plugin exited with an error", "error", err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// pluginSettings is the jsonData of the datasource. Empty fields keep the
+// value from the config file, or the default of the matching flag.
+type pluginSettings struct {
+	ConfigFile  string `json:"configFile"`
+	RrdPath     string `json:"rrdPath"`
+	Step        int    `json:"step"`
+	SearchCache int64  `json:"searchCache"`
+	Multiplier  int    `json:"multiplier"`
+	Workers     int    `json:"workers"`
+	RrdCached   string `json:"rrdCached"`
+	Watch       bool   `json:"watch"`
+}
+
+// pluginDatasource is a datasource instance. Each has its own settings,
+// roots and search cache, so datasources of this type with different RRD
+// directories don't affect each other.
+type pluginDatasource struct {
+	backend.CallResourceHandler
+	server          *rrdServer
+	stopSearchCache func()
+}
+
+func newPluginDatasource(ctx context.Context, instanceSettings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+	var settings pluginSettings
+	if len(instanceSettings.JSONData) > 0 {
+		if err := json.Unmarshal(instanceSettings.JSONData, &settings); err != nil {
+			return nil, fmt.Errorf("cannot parse datasource settings: %w", err)
+		}
+	}
+
+	config := Config{Server: ServerConfig{
+		RrdPath:     "./sample/",
+		Step:        10,
+		SearchCache: 600,
+		Multiplier:  1,
+		Workers:     8,
+		GlobDepth:   16,
+		GlobMatches: 10000,
+	}}
+	if settings.ConfigFile != "" {
+		if err := loadConfigFile(&config, settings.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	if settings.RrdPath != "" {
+		config.Server.RrdPath = settings.RrdPath
+	}
+	if settings.Step != 0 {
+		config.Server.Step = settings.Step
+	}
+	if settings.SearchCache != 0 {
+		config.Server.SearchCache = settings.SearchCache
+	}
+	if settings.Multiplier != 0 {
+		config.Server.Multiplier = settings.Multiplier
+	}
+	if settings.Workers != 0 {
+		config.Server.Workers = settings.Workers
+	}
+	if settings.RrdCached != "" {
+		config.Server.RrdCached = settings.RrdCached
+	}
+	config.Server.Watch = config.Server.Watch || settings.Watch
+
+	s, err := newRRDServer(config)
+	if err != nil {
+		return nil, err
+	}
+	s.roots.connect()
+
+	mux := http.NewServeMux()
+	s.registerHandlers(mux)
+	return &pluginDatasource{
+		CallResourceHandler: httpadapter.New(mux),
+		server:              s,
+		stopSearchCache:     s.startSearchCache(),
+	}, nil
+}
+
+// Dispose is called when the datasource settings change or it is deleted
+func (d *pluginDatasource) Dispose() {
+	d.stopSearchCache()
+	d.server.roots.close()
+}
+
+// QueryData runs the queries of a request. Queries with the same time range
+// and resolution are evaluated together, so expressions can reference them
+// by refId like in /query.
+//
+// Access rules don't apply to queries: Grafana decides who may query the
+// datasource, and its users aren't the users of the auth settings.
+func (d *pluginDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	response := backend.NewQueryDataResponse()
+
+	type windowKey struct {
+		from, to      int64
+		interval      time.Duration
+		maxDataPoints int64
+	}
+	var keys []windowKey
+	groups := map[windowKey][]backend.DataQuery{}
+	for _, q := range req.Queries {
+		key := windowKey{q.TimeRange.From.UnixNano(), q.TimeRange.To.UnixNano(), q.Interval, q.MaxDataPoints}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], q)
+	}
+
+	for _, key := range keys {
+		queries := groups[key]
+		targets := make([]QueryTarget, len(queries))
+		for i, q := range queries {
+			if err := json.Unmarshal(q.JSON, &targets[i]); err != nil {
+				response.Responses[q.RefID] = backend.ErrDataResponse(backend.StatusBadRequest, "cannot parse query: "+err.Error())
+				targets[i] = QueryTarget{Hide: true}
+			}
+			targets[i].RefID = q.RefID
+		}
+
+		from, to := queries[0].TimeRange.From, queries[0].TimeRange.To
+		step := d.server.queryStep(QueryRequest{IntervalMs: key.interval.Milliseconds(), MaxDataPoints: key.maxDataPoints}, from, to)
+		window := fetchWindow{From: from, To: to, Step: step, MaxDataPoints: key.maxDataPoints}
+
+		targetSeries, err := d.server.evalTargets(targets, window, nil)
+		for i, q := range queries {
+			if _, failed := response.Responses[q.RefID]; failed {
+				continue
+			}
+			switch {
+			case err != nil:
+				response.Responses[q.RefID] = backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+			case targets[i].Hide:
+				response.Responses[q.RefID] = backend.DataResponse{}
+			case targets[i].Type == "table":
+				response.Responses[q.RefID] = backend.DataResponse{Frames: data.Frames{tableFrame(q.RefID, targetSeries[i])}}
+			default:
+				response.Responses[q.RefID] = backend.DataResponse{Frames: seriesFrames(q.RefID, targetSeries[i])}
+			}
+		}
+	}
+	return response, nil
+}
+
+// seriesFrames returns a time/value frame per series, with the same field
+// config and labels as the "frames" format of /query
+func seriesFrames(refID string, series []QueryResponse) data.Frames {
+	frames := make(data.Frames, 0, len(series))
+	for _, s := range series {
+		times := make([]time.Time, len(s.DataPoints))
+		values := make([]float64, len(s.DataPoints))
+		for i, p := range s.DataPoints {
+			times[i] = time.UnixMilli(int64(p[1]))
+			values[i] = p[0]
+		}
+		config := &data.FieldConfig{DisplayNameFromDS: s.Target}
+		var labels data.Labels
+		if meta := s.meta; meta != nil {
+			labels = meta.labels
+			config.Unit = meta.unit
+			if !math.IsNaN(meta.min) {
+				min := data.ConfFloat64(meta.min)
+				config.Min = &min
+			}
+			if !math.IsNaN(meta.max) {
+				max := data.ConfFloat64(meta.max)
+				config.Max = &max
+			}
+		}
+		valueField := data.NewField("value", labels, values)
+		valueField.Config = config
+		frame := data.NewFrame(s.Target, data.NewField("time", nil, times), valueField)
+		frame.RefID = refID
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// tableFrame returns the rows of seriesTable as a frame
+func tableFrame(refID string, series []QueryResponse) *data.Frame {
+	table := seriesTable(series)
+	targets := make([]string, len(table.Rows))
+	times := make([]*time.Time, len(table.Rows))
+	stats := make([][]*float64, 4)
+	for i := range stats {
+		stats[i] = make([]*float64, len(table.Rows))
+	}
+	for i, row := range table.Rows {
+		targets[i] = row[0].(string)
+		if row[1] == nil {
+			continue
+		}
+		t := time.UnixMilli(row[1].(int64))
+		times[i] = &t
+		for j := range stats {
+			v := row[j+2].(float64)
+			stats[j][i] = &v
+		}
+	}
+
+	frame := data.NewFrame("table",
+		data.NewField(tableColumns[0].Text, nil, targets),
+		data.NewField(tableColumns[1].Text, nil, times),
+	)
+	for j := range stats {
+		frame.Fields = append(frame.Fields, data.NewField(tableColumns[j+2].Text, nil, stats[j]))
+	}
+	frame.RefID = refID
+	return frame
+}
+
+// CheckHealth reports whether the roots are readable
+func (d *pluginDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	for _, root := range d.server.roots {
+		info, err := os.Stat(root.path)
+		if err != nil {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: fmt.Sprintf("Cannot read RRD root %q: %v", root.name, err),
+			}, nil
+		}
+		if !info.IsDir() {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: fmt.Sprintf("RRD root %q is not a directory: %s", root.name, root.path),
+			}, nil
+		}
+		if root.rrdcached != nil && !root.cached() {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: fmt.Sprintf("Not connected to rrdcached at %s for root %q", root.rrdcached.address, root.name),
+			}, nil
+		}
+	}
+
+	return &backend.CheckHealthResult{
+		Status:  backend.HealthStatusOk,
+		Message: fmt.Sprintf("%d data sources found in %d roots", len(d.server.searchCache.Get()), len(d.server.roots)),
+	}, nil
+}
@@ -0,0 +1,1094 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// This file implements the read side of the Prometheus HTTP API on top of
+// the search cache, so Grafana's built-in Prometheus datasource can read RRD
+// files. Each "path:to:file:ds" item becomes a series with the labels
+//
+//	__name__  the ds name, with characters PromQL doesn't allow replaced by "_"
+//	ds        the ds name
+//	file      the RRD file name without ".rrd"
+//	path      the colon separated path of the file, e.g. "librenms:host:port-id66"
+//	dir1..N   the directories leading to the file
+//
+// Queries support a subset of PromQL: selectors with label matchers,
+// rate/irate/increase and the *_over_time functions over range selectors,
+// sum/avg/min/max/count with by/without, and + - * / between series and
+// numbers.
+
+// promLookback is how far back an instant selector looks for a sample
+const promLookback = 5 * time.Minute
+
+var promNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type promQueryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+type promMatrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][]interface{}   `json:"values"`
+}
+
+type promVectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value"`
+}
+
+// promLabels returns the labels of a search cache item
+func promLabels(item string) map[string]string {
+	parts := strings.Split(item, ":")
+	ds := parts[len(parts)-1]
+	name := promNameInvalid.ReplaceAllString(ds, "_")
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+
+	labels := map[string]string{
+		"__name__": name,
+		"ds":       ds,
+		"path":     strings.Join(parts[:len(parts)-1], ":"),
+	}
+	if len(parts) > 1 {
+		labels["file"] = parts[len(parts)-2]
+	}
+	for i := 0; i < len(parts)-2; i++ {
+		labels["dir"+strconv.Itoa(i+1)] = parts[i]
+	}
+	return labels
+}
+
+func respondProm(w http.ResponseWriter, data interface{}) {
+	respondJSON(w, promResponse{Status: "success", Data: data})
+}
+
+func respondPromError(w http.ResponseWriter, status int, errorType string, err error) {
+	respondJSONStatus(w, status, promResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+}
+
+// parsePromTime accepts unix timestamps with optional fractions and RFC3339
+func parsePromTime(value string, defaultTime time.Time) (time.Time, error) {
+	if value == "" {
+		return defaultTime, nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", value)
+	}
+	return t, nil
+}
+
+// parsePromDuration accepts seconds with optional fractions and PromQL
+// durations such as "5m" or "1h30m"
+func parsePromDuration(value string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		// NaN fails both comparisons, and +Inf the second one
+		if !(f > 0 && f < math.MaxInt64/float64(time.Second)) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration", value)
+		}
+		d := time.Duration(f * float64(time.Second))
+		if d <= 0 {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration", value)
+		}
+		return d, nil
+	}
+
+	units := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+	var d time.Duration
+	rest := value
+	for rest != "" {
+		i := 0
+		for i < len(rest) && unicode.IsDigit(rune(rest[i])) {
+			i++
+		}
+		j := i
+		for j < len(rest) && unicode.IsLetter(rune(rest[j])) {
+			j++
+		}
+		n, err := strconv.Atoi(rest[:i])
+		unit, ok := units[rest[i:j]]
+		if err != nil || !ok {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration", value)
+		}
+		d += time.Duration(n) * unit
+		rest = rest[j:]
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("cannot parse %q to a valid duration", value)
+	}
+	return d, nil
+}
+
+func (s *rrdServer) promQueryRange(w http.ResponseWriter, r *http.Request) {
+	for _, param := range []string{"start", "end"} {
+		if r.FormValue(param) == "" {
+			respondPromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("missing parameter %q", param))
+			return
+		}
+	}
+	start, err := parsePromTime(r.FormValue("start"), time.Time{})
+	if err != nil {
+		respondPromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	end, err := parsePromTime(r.FormValue("end"), time.Time{})
+	if err != nil {
+		respondPromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	step, err := parsePromDuration(r.FormValue("step"))
+	if err != nil {
+		respondPromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if end.Before(start) {
+		respondPromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("end timestamp must not be before start time"))
+		return
+	}
+	// Same limit as Prometheus, to keep the evaluation bounded
+	if end.Sub(start)/step > 11000 {
+		respondPromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("exceeded maximum resolution of 11,000 points per timeseries"))
+		return
+	}
+
+	node, err := parsePromQL(r.FormValue("query"))
+	if err != nil {
+		respondPromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	ev := newPromEvaluator(s, start, end, step)
+	ev.access = s.accessFor(r)
+	v, err := ev.eval(node)
+	if err != nil {
+		respondPromError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+
+	respondProm(w, promQueryData{ResultType: "matrix", Result: ev.matrix(v)})
+}
+
+func (s *rrdServer) promQuery(w http.ResponseWriter, r *http.Request) {
+	t, err := parsePromTime(r.FormValue("time"), time.Now())
+	if err != nil {
+		respondPromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	node, err := parsePromQL(r.FormValue("query"))
+	if err != nil {
+		respondPromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	ev := newPromEvaluator(s, t, t, time.Duration(s.config.Server.Step)*time.Second)
+	ev.access = s.accessFor(r)
+	v, err := ev.eval(node)
+	if err != nil {
+		respondPromError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+
+	ts := float64(t.UnixMilli()) / 1000
+	if v.isScalar {
+		respondProm(w, promQueryData{ResultType: "scalar", Result: []interface{}{ts, formatPromValue(v.scalar[0])}})
+		return
+	}
+	result := []promVectorSample{}
+	for _, s := range v.vector {
+		if !math.IsNaN(s.values[0]) {
+			result = append(result, promVectorSample{Metric: s.labels, Value: []interface{}{ts, formatPromValue(s.values[0])}})
+		}
+	}
+	respondProm(w, promQueryData{ResultType: "vector", Result: result})
+}
+
+// promSelectorsMatch parses the match[] parameters of the series and label
+// endpoints. Without any, every series matches.
+func (s *rrdServer) promSelectorsMatch(r *http.Request) ([]map[string]string, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	var selectors []*promSelector
+	for _, m := range r.Form["match[]"] {
+		node, err := parsePromQL(m)
+		if err != nil {
+			return nil, err
+		}
+		sel, ok := node.(*promSelector)
+		if !ok {
+			return nil, fmt.Errorf("match[] must be a series selector: %q", m)
+		}
+		selectors = append(selectors, sel)
+	}
+
+	var result []map[string]string
+	for _, item := range s.accessFor(r).searchItems(s.searchCache) {
+		labels := promLabels(item)
+		matched := len(selectors) == 0
+		for _, sel := range selectors {
+			if sel.matches(labels) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			result = append(result, labels)
+		}
+	}
+	return result, nil
+}
+
+func (s *rrdServer) promSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	if len(r.URL.Query()["match[]"]) == 0 && r.PostFormValue("match[]") == "" {
+		respondPromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("no match[] parameter provided"))
+		return
+	}
+	series, err := s.promSelectorsMatch(r)
+	if err != nil {
+		respondPromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if series == nil {
+		series = []map[string]string{}
+	}
+	respondProm(w, series)
+}
+
+func (s *rrdServer) promLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	series, err := s.promSelectorsMatch(r)
+	if err != nil {
+		respondPromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	names := map[string]bool{}
+	for _, labels := range series {
+		for name := range labels {
+			names[name] = true
+		}
+	}
+	respondProm(w, sortedKeys(names))
+}
+
+// promLabelValuesHandler serves /api/v1/label/<name>/values
+func (s *rrdServer) promLabelValuesHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/label/"), "/values")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	series, err := s.promSelectorsMatch(r)
+	if err != nil {
+		respondPromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	values := map[string]bool{}
+	for _, labels := range series {
+		if v, ok := labels[name]; ok {
+			values[v] = true
+		}
+	}
+	respondProm(w, sortedKeys(values))
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatPromValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// PromQL syntax tree
+
+type promNode interface{}
+
+type promNumber struct {
+	value float64
+}
+
+type promMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+type promSelector struct {
+	matchers []promMatcher
+	// rangeDur is set for range selectors such as "x[5m]"
+	rangeDur time.Duration
+}
+
+type promCall struct {
+	fn  string
+	arg *promSelector
+}
+
+type promAggregation struct {
+	op       string
+	grouping []string
+	without  bool
+	arg      promNode
+}
+
+type promBinary struct {
+	op       string
+	lhs, rhs promNode
+}
+
+var promRangeFunctions = map[string]bool{
+	"rate":            true,
+	"irate":           true,
+	"increase":        true,
+	"avg_over_time":   true,
+	"min_over_time":   true,
+	"max_over_time":   true,
+	"sum_over_time":   true,
+	"count_over_time": true,
+	"last_over_time":  true,
+}
+
+var promAggregations = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+func (m promMatcher) matches(labels map[string]string) bool {
+	v := labels[m.name]
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	case "!~":
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+func (s *promSelector) matches(labels map[string]string) bool {
+	for _, m := range s.matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// PromQL lexer and parser
+
+type promToken struct {
+	kind  string // "ident", "number", "string", "duration" or the punctuation itself
+	value string
+}
+
+func lexPromQL(query string) ([]promToken, error) {
+	var tokens []promToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '[':
+			j := i + 1
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unclosed range selector")
+			}
+			tokens = append(tokens, promToken{"duration", strings.TrimSpace(string(runes[i+1 : j]))})
+			i = j + 1
+		case r == '"' || r == '\'' || r == '`':
+			j := i + 1
+			var sb strings.Builder
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && r != '`' && j+1 < len(runes) {
+					j++
+					switch runes[j] {
+					case 'n':
+						sb.WriteRune('\n')
+					case 't':
+						sb.WriteRune('\t')
+					default:
+						sb.WriteRune(runes[j])
+					}
+					continue
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, promToken{"string", sb.String()})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == 'e' || runes[j] == 'E' ||
+				((runes[j] == '+' || runes[j] == '-') && (runes[j-1] == 'e' || runes[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, promToken{"number", string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_' || r == ':':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == ':') {
+				j++
+			}
+			tokens = append(tokens, promToken{"ident", string(runes[i:j])})
+			i = j
+		default:
+			if i+1 < len(runes) {
+				two := string(runes[i : i+2])
+				if two == "!=" || two == "=~" || two == "!~" {
+					tokens = append(tokens, promToken{two, two})
+					i += 2
+					continue
+				}
+			}
+			if strings.ContainsRune("(){},=+-*/", r) {
+				tokens = append(tokens, promToken{string(r), string(r)})
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	return tokens, nil
+}
+
+type promParser struct {
+	tokens []promToken
+	pos    int
+}
+
+func parsePromQL(query string) (promNode, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("empty query")
+	}
+	tokens, err := lexPromQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &promParser{tokens: tokens}
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].value)
+	}
+	return node, nil
+}
+
+func (p *promParser) peek() promToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return promToken{}
+}
+
+func (p *promParser) expect(kind string) (promToken, error) {
+	t := p.peek()
+	if t.kind != kind {
+		if t.kind == "" {
+			return t, fmt.Errorf("unexpected end of query, expected %q", kind)
+		}
+		return t, fmt.Errorf("unexpected %q, expected %q", t.value, kind)
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *promParser) expr() (promNode, error) {
+	lhs, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for k := p.peek().kind; k == "+" || k == "-"; k = p.peek().kind {
+		p.pos++
+		rhs, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &promBinary{op: k, lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *promParser) term() (promNode, error) {
+	lhs, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for k := p.peek().kind; k == "*" || k == "/"; k = p.peek().kind {
+		p.pos++
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &promBinary{op: k, lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *promParser) unary() (promNode, error) {
+	t := p.peek()
+	switch t.kind {
+	case "-":
+		p.pos++
+		arg, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &promBinary{op: "*", lhs: &promNumber{value: -1}, rhs: arg}, nil
+	case "number":
+		p.pos++
+		v, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.value)
+		}
+		return &promNumber{value: v}, nil
+	case "(":
+		p.pos++
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case "{":
+		return p.selector("")
+	case "ident":
+		p.pos++
+		switch {
+		case promAggregations[t.value]:
+			return p.aggregation(t.value)
+		case promRangeFunctions[t.value] && p.peek().kind == "(":
+			p.pos++
+			node, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			sel, ok := node.(*promSelector)
+			if !ok || sel.rangeDur == 0 {
+				return nil, fmt.Errorf("%s() expects a range selector", t.value)
+			}
+			if _, err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return &promCall{fn: t.value, arg: sel}, nil
+		case p.peek().kind == "(":
+			return nil, fmt.Errorf("unsupported function %q", t.value)
+		}
+		return p.selector(t.value)
+	case "":
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	return nil, fmt.Errorf("unexpected %q", t.value)
+}
+
+func (p *promParser) selector(name string) (promNode, error) {
+	sel := &promSelector{}
+	if name != "" {
+		sel.matchers = append(sel.matchers, promMatcher{name: "__name__", op: "=", value: name})
+	}
+
+	if p.peek().kind == "{" {
+		p.pos++
+		for p.peek().kind != "}" {
+			label, err := p.expect("ident")
+			if err != nil {
+				return nil, err
+			}
+			op := p.peek()
+			if op.kind != "=" && op.kind != "!=" && op.kind != "=~" && op.kind != "!~" {
+				return nil, fmt.Errorf("unexpected %q in label matcher", op.value)
+			}
+			p.pos++
+			value, err := p.expect("string")
+			if err != nil {
+				return nil, err
+			}
+			m := promMatcher{name: label.value, op: op.kind, value: value.value}
+			if op.kind == "=~" || op.kind == "!~" {
+				if m.re, err = regexp.Compile("^(?:" + value.value + ")$"); err != nil {
+					return nil, err
+				}
+			}
+			sel.matchers = append(sel.matchers, m)
+			if p.peek().kind == "," {
+				p.pos++
+			}
+		}
+		p.pos++
+	}
+	if len(sel.matchers) == 0 {
+		return nil, fmt.Errorf("vector selector must contain at least one matcher")
+	}
+
+	if p.peek().kind == "duration" {
+		d, err := parsePromDuration(p.tokens[p.pos].value)
+		if err != nil {
+			return nil, err
+		}
+		sel.rangeDur = d
+		p.pos++
+	}
+	return sel, nil
+}
+
+func (p *promParser) grouping() ([]string, error) {
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var labels []string
+	for p.peek().kind != ")" {
+		label, err := p.expect("ident")
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label.value)
+		if p.peek().kind == "," {
+			p.pos++
+		}
+	}
+	p.pos++
+	return labels, nil
+}
+
+func (p *promParser) aggregation(op string) (promNode, error) {
+	aggr := &promAggregation{op: op}
+	parseModifier := func() error {
+		t := p.peek()
+		if t.kind == "ident" && (t.value == "by" || t.value == "without") {
+			p.pos++
+			aggr.without = t.value == "without"
+			labels, err := p.grouping()
+			if err != nil {
+				return err
+			}
+			aggr.grouping = labels
+		}
+		return nil
+	}
+
+	if err := parseModifier(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	arg, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if aggr.grouping == nil {
+		if err := parseModifier(); err != nil {
+			return nil, err
+		}
+	}
+	aggr.arg = arg
+	return aggr, nil
+}
+
+// PromQL evaluation
+
+type promSeries struct {
+	labels map[string]string
+	// values holds one value per evaluation step, NaN where there is none
+	values []float64
+}
+
+type promValue struct {
+	scalar   []float64
+	vector   []promSeries
+	isScalar bool
+}
+
+type promEvaluator struct {
+	server     *rrdServer
+	start, end time.Time
+	step       time.Duration
+	steps      []time.Time
+	// access limits the series selectors match
+	access pathAccess
+}
+
+func newPromEvaluator(server *rrdServer, start, end time.Time, step time.Duration) *promEvaluator {
+	ev := &promEvaluator{server: server, start: start, end: end, step: step}
+	for t := start; !t.After(end); t = t.Add(step) {
+		ev.steps = append(ev.steps, t)
+	}
+	return ev
+}
+
+func (ev *promEvaluator) eval(node promNode) (promValue, error) {
+	switch n := node.(type) {
+	case *promNumber:
+		values := make([]float64, len(ev.steps))
+		for i := range values {
+			values[i] = n.value
+		}
+		return promValue{scalar: values, isScalar: true}, nil
+	case *promSelector:
+		if n.rangeDur != 0 {
+			return promValue{}, fmt.Errorf("range selectors are only supported as function arguments")
+		}
+		return ev.evalRange(n, promLookback, func(samples [][]float64, _ time.Time) float64 {
+			return samples[len(samples)-1][0]
+		}, true)
+	case *promCall:
+		return ev.evalRange(n.arg, n.arg.rangeDur, promRangeFunction(n.fn, n.arg.rangeDur), n.fn == "last_over_time")
+	case *promAggregation:
+		arg, err := ev.eval(n.arg)
+		if err != nil {
+			return promValue{}, err
+		}
+		if arg.isScalar {
+			return promValue{}, fmt.Errorf("%s() expects a vector", n.op)
+		}
+		return promValue{vector: aggregateProm(n, arg.vector, len(ev.steps))}, nil
+	case *promBinary:
+		lhs, err := ev.eval(n.lhs)
+		if err != nil {
+			return promValue{}, err
+		}
+		rhs, err := ev.eval(n.rhs)
+		if err != nil {
+			return promValue{}, err
+		}
+		return binaryProm(n.op, lhs, rhs), nil
+	}
+	return promValue{}, fmt.Errorf("unsupported expression")
+}
+
+// evalRange fetches the series matched by sel and computes f over the
+// samples in (t - window, t] for every evaluation step t. Like wildcard
+// targets, sel may match at most config.Server.GlobMatches series.
+func (ev *promEvaluator) evalRange(sel *promSelector, window time.Duration, f func(samples [][]float64, t time.Time) float64, keepName bool) (promValue, error) {
+	if window < ev.step {
+		window = ev.step
+	}
+
+	var labels []map[string]string
+	var jobs []seriesJob
+	for _, item := range ev.access.searchItems(ev.server.searchCache) {
+		l := promLabels(item)
+		if !sel.matches(l) {
+			continue
+		}
+		root, filePath := ev.server.roots.fileForTarget(l["path"])
+		if root == nil {
+			continue
+		}
+		if !keepName {
+			delete(l, "__name__")
+		}
+		labels = append(labels, l)
+		jobs = append(jobs, seriesJob{root: root, filePath: filePath, ds: l["ds"]})
+		if limit := ev.server.config.Server.GlobMatches; limit > 0 && len(jobs) > limit {
+			return promValue{}, fmt.Errorf("selector matches more than %d series", limit)
+		}
+	}
+
+	fw := fetchWindow{From: ev.start.Add(-window), To: ev.end, Step: ev.step}
+	fetched := ev.server.fetchAllSeries(jobs, fw)
+
+	result := promValue{}
+	for i, s := range fetched {
+		if s == nil {
+			continue
+		}
+		values := make([]float64, len(ev.steps))
+		found := false
+		first := 0
+		for j, t := range ev.steps {
+			from := float64(t.Add(-window).UnixMilli())
+			to := float64(t.UnixMilli())
+			for first < len(s.DataPoints) && s.DataPoints[first][1] <= from {
+				first++
+			}
+			last := first
+			for last < len(s.DataPoints) && s.DataPoints[last][1] <= to {
+				last++
+			}
+			values[j] = math.NaN()
+			if last > first {
+				if v := f(s.DataPoints[first:last], t); validPoint(v) {
+					values[j] = v
+					found = true
+				}
+			}
+		}
+		if found {
+			result.vector = append(result.vector, promSeries{labels: labels[i], values: values})
+		}
+	}
+	return result, nil
+}
+
+// promRangeFunction returns the function computing fn over the samples
+// (value, timestamp in ms) of one window
+func promRangeFunction(fn string, window time.Duration) func(samples [][]float64, t time.Time) float64 {
+	// increaseOf sums the increase between samples, treating drops as resets
+	increaseOf := func(samples [][]float64) float64 {
+		var inc float64
+		for i := 1; i < len(samples); i++ {
+			if d := samples[i][0] - samples[i-1][0]; d >= 0 {
+				inc += d
+			} else {
+				inc += samples[i][0]
+			}
+		}
+		return inc
+	}
+
+	return func(samples [][]float64, t time.Time) float64 {
+		n := len(samples)
+		switch fn {
+		case "rate", "increase":
+			if n < 2 {
+				return math.NaN()
+			}
+			elapsed := (samples[n-1][1] - samples[0][1]) / 1000
+			rate := increaseOf(samples) / elapsed
+			if fn == "increase" {
+				return rate * window.Seconds()
+			}
+			return rate
+		case "irate":
+			if n < 2 {
+				return math.NaN()
+			}
+			return increaseOf(samples[n-2:]) / ((samples[n-1][1] - samples[n-2][1]) / 1000)
+		case "avg_over_time", "min_over_time", "max_over_time", "sum_over_time", "count_over_time":
+			values := make([]float64, n)
+			for i, s := range samples {
+				values[i] = s[0]
+			}
+			return aggregateValues(strings.TrimSuffix(fn, "_over_time"), values)
+		case "last_over_time":
+			return samples[n-1][0]
+		}
+		return math.NaN()
+	}
+}
+
+func aggregateValues(op string, values []float64) float64 {
+	switch op {
+	case "sum":
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	case "count":
+		return float64(len(values))
+	case "avg":
+		return consolidate(values, "AVERAGE")
+	case "min":
+		return consolidate(values, "MIN")
+	case "max":
+		return consolidate(values, "MAX")
+	}
+	return math.NaN()
+}
+
+func aggregateProm(aggr *promAggregation, vector []promSeries, steps int) []promSeries {
+	groupLabels := func(labels map[string]string) map[string]string {
+		result := map[string]string{}
+		if aggr.without {
+			for k, v := range labels {
+				result[k] = v
+			}
+			delete(result, "__name__")
+			for _, name := range aggr.grouping {
+				delete(result, name)
+			}
+			return result
+		}
+		for _, name := range aggr.grouping {
+			if v, ok := labels[name]; ok {
+				result[name] = v
+			}
+		}
+		return result
+	}
+
+	var keys []string
+	groups := map[string][]promSeries{}
+	groupSet := map[string]map[string]string{}
+	for _, s := range vector {
+		labels := groupLabels(s.labels)
+		key := promLabelsKey(labels)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			groupSet[key] = labels
+		}
+		groups[key] = append(groups[key], s)
+	}
+	sort.Strings(keys)
+
+	result := make([]promSeries, 0, len(keys))
+	for _, key := range keys {
+		values := make([]float64, steps)
+		for i := range values {
+			var stepValues []float64
+			for _, s := range groups[key] {
+				if !math.IsNaN(s.values[i]) {
+					stepValues = append(stepValues, s.values[i])
+				}
+			}
+			values[i] = math.NaN()
+			if len(stepValues) > 0 {
+				values[i] = aggregateValues(aggr.op, stepValues)
+			}
+		}
+		result = append(result, promSeries{labels: groupSet[key], values: values})
+	}
+	return result
+}
+
+// promLabelsKey returns a stable identity for a label set
+func promLabelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name + "=" + strconv.Quote(labels[name]) + ",")
+	}
+	return sb.String()
+}
+
+// binaryProm applies op between two values. Series are matched on their
+// labels without __name__, like PromQL's default one-to-one matching.
+func binaryProm(op string, lhs, rhs promValue) promValue {
+	apply := func(a, b []float64) []float64 {
+		values := make([]float64, len(a))
+		for i := range a {
+			values[i] = calc(op, a[i], b[i])
+			if !validPoint(values[i]) {
+				values[i] = math.NaN()
+			}
+		}
+		return values
+	}
+	withoutName := func(labels map[string]string) map[string]string {
+		result := map[string]string{}
+		for k, v := range labels {
+			if k != "__name__" {
+				result[k] = v
+			}
+		}
+		return result
+	}
+
+	switch {
+	case lhs.isScalar && rhs.isScalar:
+		return promValue{scalar: apply(lhs.scalar, rhs.scalar), isScalar: true}
+	case rhs.isScalar:
+		result := promValue{}
+		for _, s := range lhs.vector {
+			result.vector = append(result.vector, promSeries{labels: withoutName(s.labels), values: apply(s.values, rhs.scalar)})
+		}
+		return result
+	case lhs.isScalar:
+		result := promValue{}
+		for _, s := range rhs.vector {
+			result.vector = append(result.vector, promSeries{labels: withoutName(s.labels), values: apply(lhs.scalar, s.values)})
+		}
+		return result
+	}
+
+	rhsByLabels := map[string]promSeries{}
+	for _, s := range rhs.vector {
+		rhsByLabels[promLabelsKey(withoutName(s.labels))] = s
+	}
+	result := promValue{}
+	for _, s := range lhs.vector {
+		labels := withoutName(s.labels)
+		if other, ok := rhsByLabels[promLabelsKey(labels)]; ok {
+			result.vector = append(result.vector, promSeries{labels: labels, values: apply(s.values, other.values)})
+		}
+	}
+	return result
+}
+
+// matrix converts a value to the matrix result of a range query
+func (ev *promEvaluator) matrix(v promValue) []promMatrixSeries {
+	series := v.vector
+	if v.isScalar {
+		series = []promSeries{{labels: map[string]string{}, values: v.scalar}}
+	}
+
+	result := []promMatrixSeries{}
+	for _, s := range series {
+		values := [][]interface{}{}
+		for i, t := range ev.steps {
+			if !math.IsNaN(s.values[i]) {
+				values = append(values, []interface{}{float64(t.UnixMilli()) / 1000, formatPromValue(s.values[i])})
+			}
+		}
+		if len(values) > 0 {
+			result = append(result, promMatrixSeries{Metric: s.labels, Values: values})
+		}
+	}
+	return result
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPromLabels(t *testing.T) {
+	labels := promLabels("librenms:host:port-id66:INOCTETS")
+	expected := map[string]string{
+		"__name__": "INOCTETS",
+		"ds":       "INOCTETS",
+		"file":     "port-id66",
+		"path":     "librenms:host:port-id66",
+		"dir1":     "librenms",
+		"dir2":     "host",
+	}
+	if len(labels) != len(expected) {
+		t.Fatalf("Unexpected labels. %v", labels)
+	}
+	for k, v := range expected {
+		if labels[k] != v {
+			t.Fatalf("Label %s should be %q but %q.", k, v, labels[k])
+		}
+	}
+
+	if name := promLabels("sample:1min-load")["__name__"]; name != "_1min_load" {
+		t.Fatalf("Metric name isn't sanitized. %q", name)
+	}
+}
+
+func TestParsePromQL(t *testing.T) {
+	for _, q := range []string{
+		`value`,
+		`value{file=~"percent-.*", dir1!="sample"}[5m]`,
+		`sum by (file) (rate(value{dir1="percent"}[1m]))`,
+		`avg without (ds) (value) * 8`,
+		`-1 + 2 / (3 - value)`,
+	} {
+		if _, err := parsePromQL(q); err != nil {
+			t.Fatalf("Cannot parse %q. %v", q, err)
+		}
+	}
+
+	for _, q := range []string{``, `{}`, `rate(value)`, `histogram_quantile(0.9, value)`, `value{file="x"`, `sum(value`, `value[5x]`} {
+		if _, err := parsePromQL(q); err == nil {
+			t.Fatalf("Expected an error for %q.", q)
+		}
+	}
+}
+
+type promTestResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Data      struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func TestPromQueryRange(t *testing.T) {
+	s := sampleServer(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.promQueryRange))
+	defer ts.Close()
+
+	queryRange := func(query string) (int, promTestResponse) {
+		form := url.Values{
+			"query": {query},
+			"start": {"2016-12-08T01:30:00Z"},
+			"end":   {"2016-12-08T02:00:00Z"},
+			"step":  {"60"},
+		}
+		r, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatalf("Error at a POST request. %v", err)
+		}
+		var response promTestResponse
+		if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+			t.Fatalf("Error at decoding JSON response. %v", err)
+		}
+		return r.StatusCode, response
+	}
+
+	status, plain := queryRange(`value{dir1="percent"}`)
+	if status != 200 || plain.Data.ResultType != "matrix" {
+		t.Fatalf("Unexpected response %d %v.", status, plain)
+	}
+	if len(plain.Data.Result) != 2 {
+		t.Fatalf("Two series should match. %v", plain.Data.Result)
+	}
+	if len(plain.Data.Result[0].Values) == 0 {
+		t.Fatal("There should be values.")
+	}
+
+	_, summed := queryRange(`sum(value{dir1="percent"})`)
+	if len(summed.Data.Result) != 1 || len(summed.Data.Result[0].Metric) != 0 {
+		t.Fatalf("sum() should return a single series without labels. %v", summed.Data.Result)
+	}
+
+	_, grouped := queryRange(`max by (file) (max_over_time(value{dir1="percent"}[5m]))`)
+	if len(grouped.Data.Result) != 2 || grouped.Data.Result[0].Metric["file"] != "percent-idle" {
+		t.Fatalf("max by (file) should return a series per file. %v", grouped.Data.Result)
+	}
+
+	_, doubled := queryRange(`value{file="percent-idle"} * 2`)
+	if len(doubled.Data.Result) != 1 {
+		t.Fatalf("Unexpected result. %v", doubled.Data.Result)
+	}
+	if _, ok := doubled.Data.Result[0].Metric["__name__"]; ok {
+		t.Fatal("Arithmetic should drop the metric name.")
+	}
+	for i, p := range doubled.Data.Result[0].Values {
+		var orig, v float64
+		json.Unmarshal([]byte(plain.Data.Result[0].Values[i][1].(string)), &orig)
+		json.Unmarshal([]byte(p[1].(string)), &v)
+		if v != orig*2 {
+			t.Fatalf("%v should be twice %v.", v, orig)
+		}
+	}
+
+	status, invalid := queryRange(`sum(`)
+	if status != 400 || invalid.Status != "error" {
+		t.Fatalf("Invalid queries should fail with 400. %d %v", status, invalid)
+	}
+
+	for _, step := range []string{"0", "-60", "0.0000000001", "NaN", "Inf"} {
+		form := url.Values{
+			"query": {`value{dir1="percent"}`},
+			"start": {"2016-12-08T01:30:00Z"},
+			"end":   {"2016-12-08T02:00:00Z"},
+			"step":  {step},
+		}
+		r, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatalf("Error at a POST request. %v", err)
+		}
+		r.Body.Close()
+		if r.StatusCode != 400 {
+			t.Fatalf("Step %s should fail with 400 but %d.", step, r.StatusCode)
+		}
+	}
+
+	for _, missing := range []string{"start", "end"} {
+		form := url.Values{
+			"query": {`value{dir1="percent"}`},
+			"start": {"2016-12-08T01:30:00Z"},
+			"end":   {"2016-12-08T02:00:00Z"},
+			"step":  {"60"},
+		}
+		form.Del(missing)
+		r, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatalf("Error at a POST request. %v", err)
+		}
+		var response promTestResponse
+		json.NewDecoder(r.Body).Decode(&response)
+		if r.StatusCode != 400 || response.ErrorType != "bad_data" {
+			t.Fatalf("A missing %s should fail with 400 but %d %v.", missing, r.StatusCode, response)
+		}
+	}
+
+	s.config.Server.GlobMatches = 1
+	if status, _ := queryRange(`value{dir1="percent"}`); status != http.StatusUnprocessableEntity {
+		t.Fatalf("Selectors matching more series than the limit should fail with 422 but %d.", status)
+	}
+}
+
+func TestPromQuery(t *testing.T) {
+	s := sampleServer(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.promQuery))
+	defer ts.Close()
+
+	r, err := http.Get(ts.URL + "?query=" + url.QueryEscape("1+1") + "&time=1481151600")
+	if err != nil {
+		t.Fatalf("Error at a GET request. %v", err)
+	}
+	var response struct {
+		Data struct {
+			ResultType string        `json:"resultType"`
+			Result     []interface{} `json:"result"`
+		} `json:"data"`
+	}
+	json.NewDecoder(r.Body).Decode(&response)
+	if response.Data.ResultType != "scalar" || response.Data.Result[1] != "2" {
+		t.Fatalf("1+1 should be the scalar 2. %v", response.Data)
+	}
+}
+
+func TestPromSeriesAndLabels(t *testing.T) {
+	s := sampleServer(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", s.promSeriesHandler)
+	mux.HandleFunc("/api/v1/labels", s.promLabelsHandler)
+	mux.HandleFunc("/api/v1/label/", s.promLabelValuesHandler)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(path string, v interface{}) int {
+		r, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("Error at a GET request. %v", err)
+		}
+		json.NewDecoder(r.Body).Decode(v)
+		return r.StatusCode
+	}
+
+	var series struct {
+		Data []map[string]string `json:"data"`
+	}
+	get("/api/v1/series?match[]="+url.QueryEscape(`{dir1="percent"}`), &series)
+	if len(series.Data) != 2 {
+		t.Fatalf("Two series should match. %v", series.Data)
+	}
+	if status := get("/api/v1/series", &series); status != 400 {
+		t.Fatalf("match[] should be required but the status is %d.", status)
+	}
+
+	var labels struct {
+		Data []string `json:"data"`
+	}
+	get("/api/v1/labels", &labels)
+	if !strings.Contains(strings.Join(labels.Data, ","), "__name__,dir1,") {
+		t.Fatalf("Unexpected label names. %v", labels.Data)
+	}
+
+	get("/api/v1/label/file/values?match[]="+url.QueryEscape(`{dir1="percent"}`), &labels)
+	if strings.Join(labels.Data, ",") != "percent-idle,percent-user" {
+		t.Fatalf("Unexpected label values. %v", labels.Data)
+	}
+}
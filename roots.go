@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	rrdcached "github.com/multiplay/go-rrd"
+)
+
+// rrdRoot is a directory of RRD files. Targets of a named root start with its
+// name, e.g. "librenms:host:port-id66:INOCTETS"; an unnamed root serves its
+// files without a prefix.
+type rrdRoot struct {
+	name       string
+	path       string
+	step       int
+	multiplier float64
+	// rrdcached is nil when the files are read directly
+	rrdcached *rrdcachedConn
+}
+
+// rrdRoots are the roots of a configuration
+type rrdRoots []*rrdRoot
+
+// setupRoots builds the roots from config. Without roots in the config file
+// the -r directory is served as the only, unnamed root.
+func setupRoots(config Config) (rrdRoots, error) {
+	configs := config.Roots
+	if len(configs) == 0 {
+		configs = []RootConfig{{
+			Path:       config.Server.RrdPath,
+			Multiplier: float64(config.Server.Multiplier),
+			RrdCached:  config.Server.RrdCached,
+		}}
+	}
+
+	roots := make(rrdRoots, 0, len(configs))
+	names := map[string]bool{}
+	for _, rc := range configs {
+		if strings.ContainsAny(rc.Name, ":/*?[]@") {
+			return nil, fmt.Errorf("invalid root name %q", rc.Name)
+		}
+		if names[rc.Name] {
+			if rc.Name == "" {
+				return nil, errors.New("only one root can be unnamed")
+			}
+			return nil, fmt.Errorf("duplicate root name %q", rc.Name)
+		}
+		names[rc.Name] = true
+		if rc.Path == "" {
+			return nil, fmt.Errorf("root %q has no path", rc.Name)
+		}
+
+		root := &rrdRoot{
+			name:       rc.Name,
+			path:       filepath.Clean(rc.Path),
+			step:       rc.Step,
+			multiplier: rc.Multiplier,
+		}
+		if root.step == 0 {
+			root.step = config.Server.Step
+		}
+		if root.multiplier == 0 {
+			root.multiplier = float64(config.Server.Multiplier)
+		}
+		if rc.RrdCached != "" {
+			root.rrdcached = &rrdcachedConn{address: rc.RrdCached}
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// connect connects the roots that have an rrdcached daemon. Roots that can't
+// connect fall back to direct file access.
+func (roots rrdRoots) connect() {
+	for _, root := range roots {
+		if root.rrdcached == nil {
+			continue
+		}
+		if err := root.rrdcached.connect(); err != nil {
+			logger.Error("Failed to connect to rrdcached, falling back to direct file access",
+				"root", root.name, "daemon", root.rrdcached.address, "error", err)
+		} else {
+			logger.Info("Connected to rrdcached successfully", "root", root.name, "daemon", root.rrdcached.address)
+		}
+	}
+}
+
+func (roots rrdRoots) close() {
+	for _, root := range roots {
+		if root.rrdcached != nil {
+			root.rrdcached.close()
+		}
+	}
+}
+
+// forTarget returns the root a target belongs to and the target relative to
+// that root. Named roots take precedence over the unnamed one. It returns nil
+// if no root serves the target.
+func (roots rrdRoots) forTarget(target string) (*rrdRoot, string) {
+	var unnamed *rrdRoot
+	for _, root := range roots {
+		if root.name == "" {
+			unnamed = root
+			continue
+		}
+		if strings.HasPrefix(target, root.name+":") {
+			return root, target[len(root.name)+1:]
+		}
+	}
+	return unnamed, target
+}
+
+// fileForTarget returns the root and the RRD file of a "path:to:file" target
+func (roots rrdRoots) fileForTarget(fileTarget string) (*rrdRoot, string) {
+	root, rel := roots.forTarget(fileTarget)
+	if root == nil {
+		return nil, ""
+	}
+	return root, root.file(rel)
+}
+
+// checkFileTarget rejects "path:to:file" targets that can't name a file in
+// a root, such as ones with empty, "." or ".." segments, slashes, or
+// characters that have a meaning in targets
+func checkFileTarget(target string) error {
+	if target == "" {
+		return errors.New("empty target")
+	}
+	for _, segment := range strings.Split(target, ":") {
+		if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, "/\\*?[]@\x00") {
+			return fmt.Errorf("invalid target %q", target)
+		}
+	}
+	return nil
+}
+
+// checkTargetPattern rejects the file part of a query target when it could
+// reach files outside the roots or walk whole trees: segments that are empty,
+// "." or "..", also as a {a,b} alternative, "**", slashes and patterns with
+// wildcards deeper than depth segments
+func checkTargetPattern(pattern string, depth int) error {
+	if pattern == "" {
+		return errors.New("empty target")
+	}
+	segments := strings.Split(pattern, ":")
+	for _, segment := range segments {
+		if segment == "" || strings.Contains(segment, "**") || strings.ContainsAny(segment, "/\\\x00") {
+			return fmt.Errorf("invalid target %q", pattern)
+		}
+		alternatives := strings.FieldsFunc(segment, func(c rune) bool { return c == '{' || c == ',' || c == '}' })
+		if slices.Contains(alternatives, ".") || slices.Contains(alternatives, "..") {
+			return fmt.Errorf("invalid target %q", pattern)
+		}
+	}
+	if depth > 0 && len(segments) > depth && strings.ContainsAny(pattern, "*?[{") {
+		return fmt.Errorf("wildcard target %q is deeper than %d segments", pattern, depth)
+	}
+	return nil
+}
+
+// file returns the RRD file of a target relative to the root
+func (root *rrdRoot) file(rel string) string {
+	return filepath.Join(root.path, strings.Replace(rel, ":", "/", -1)) + ".rrd"
+}
+
+// target returns the "path:to:file" target of an RRD file in the root
+func (root *rrdRoot) target(filePath string) string {
+	rel, err := filepath.Rel(root.path, filePath)
+	if err != nil {
+		rel = filePath
+	}
+	target := strings.Replace(strings.TrimSuffix(filepath.ToSlash(rel), ".rrd"), "/", ":", -1)
+	if root.name != "" {
+		target = root.name + ":" + target
+	}
+	return target
+}
+
+// contains reports whether filePath is inside the root's directory
+func (root *rrdRoot) contains(filePath string) bool {
+	rel, err := filepath.Rel(root.path, filePath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// owns reports whether a file of root isn't shadowed by a named root, as the
+// files of "<unnamed root>/librenms" are when a root is named "librenms"
+func (roots rrdRoots) owns(root *rrdRoot, filePath string) bool {
+	owner, _ := roots.forTarget(root.target(filePath))
+	return owner == root
+}
+
+// containing returns the roots whose directory holds path
+func (roots rrdRoots) containing(path string) rrdRoots {
+	var result rrdRoots
+	for _, root := range roots {
+		if root.contains(path) {
+			result = append(result, root)
+		}
+	}
+	return result
+}
+
+// relative strips the root name off a target pattern. The first segment of
+// the pattern may be a wildcard matching several root names.
+func (root *rrdRoot) relative(pattern string) (string, bool) {
+	if root.name == "" {
+		return pattern, true
+	}
+	first, rest, found := strings.Cut(pattern, ":")
+	if !found {
+		return "", false
+	}
+	if ok, _ := path.Match(first, root.name); !ok {
+		return "", false
+	}
+	return rest, true
+}
+
+// cached reports whether the root is read through rrdcached
+func (root *rrdRoot) cached() bool {
+	return root.rrdcached != nil && root.rrdcached.connected()
+}
+
+// backend names the way the root's files are read, for metrics
+func (root *rrdRoot) backend() string {
+	if root.cached() {
+		return "rrdcached"
+	}
+	return "direct"
+}
+
+// infoCacheEntry is an RRD header read when the file had modTime and size
+type infoCacheEntry struct {
+	modTime time.Time
+	size    int64
+	info    *RRDInfo
+}
+
+// fileInfoCache keeps RRD headers keyed by file path. An entry is used as
+// long as the file's mtime and size are unchanged.
+type fileInfoCache struct {
+	m       sync.Mutex
+	entries map[string]infoCacheEntry
+}
+
+var infoCache = &fileInfoCache{entries: map[string]infoCacheEntry{}}
+
+func (c *fileInfoCache) forget(filePath string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	delete(c.entries, filePath)
+}
+
+// retain drops the entries of the files not in keep
+func (c *fileInfoCache) retain(keep map[string]bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for filePath := range c.entries {
+		if !keep[filePath] {
+			delete(c.entries, filePath)
+		}
+	}
+}
+
+// cachedInfo returns the header of an RRD file, reading it only if the file
+// changed since it was last read. Roots behind rrdcached are always read, as
+// the daemon holds updates the file's mtime doesn't reflect yet.
+func (root *rrdRoot) cachedInfo(filePath string) (*RRDInfo, error) {
+	if root.cached() {
+		return root.rrdInfo(filePath)
+	}
+
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	infoCache.m.Lock()
+	entry, ok := infoCache.entries[filePath]
+	infoCache.m.Unlock()
+	if ok && entry.modTime.Equal(stat.ModTime()) && entry.size == stat.Size() {
+		return entry.info, nil
+	}
+
+	info, err := root.rrdInfo(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	infoCache.m.Lock()
+	infoCache.entries[filePath] = infoCacheEntry{modTime: stat.ModTime(), size: stat.Size(), info: info}
+	infoCache.m.Unlock()
+	return info, nil
+}
+
+// rrdcachedConn is a connection to an rrdcached daemon. The client has a
+// single connection and can't be used by several goroutines at once, so every
+// call goes through with.
+type rrdcachedConn struct {
+	address string
+	m       sync.Mutex
+	client  *rrdcached.Client
+}
+
+// connect (re)creates the connection. The connection is left closed if it
+// fails, so the root falls back to direct file access.
+func (c *rrdcachedConn) connect() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+
+	var err error
+	var client *rrdcached.Client
+	if strings.HasPrefix(c.address, "unix:") {
+		client, err = rrdcached.NewClient(strings.TrimPrefix(c.address, "unix:"), rrdcached.Unix)
+	} else {
+		client, err = rrdcached.NewClient(c.address)
+	}
+	if err != nil {
+		return err
+	}
+	c.client = client
+	return nil
+}
+
+// reconnect recreates the connection after a timeout or connection error
+func (c *rrdcachedConn) reconnect() error {
+	if err := c.connect(); err != nil {
+		rrdcachedReconnects.WithLabelValues(c.address, "error").Inc()
+		logger.Error("Failed to reconnect to rrdcached", "daemon", c.address, "error", err)
+		return err
+	}
+	rrdcachedReconnects.WithLabelValues(c.address, "ok").Inc()
+	logger.Info("Reconnected to rrdcached", "daemon", c.address)
+	return nil
+}
+
+func (c *rrdcachedConn) connected() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.client != nil
+}
+
+func (c *rrdcachedConn) close() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// with runs f with the client while holding the connection's lock
+func (c *rrdcachedConn) with(f func(client *rrdcached.Client) error) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.client == nil {
+		return errors.New("not connected to rrdcached")
+	}
+	return f(c.client)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupRoots(t *testing.T) {
+	config := sampleConfig()
+	for _, invalid := range [][]RootConfig{
+		{{Name: "a", Path: "./sample"}, {Name: "a", Path: "./sample/percent"}},
+		{{Path: "./sample"}, {Path: "./sample/percent"}},
+		{{Name: "a:b", Path: "./sample"}},
+		{{Name: "a"}},
+	} {
+		config.Roots = invalid
+		if _, err := setupRoots(config); err == nil {
+			t.Fatalf("Expected an error for %v.", invalid)
+		}
+	}
+
+	config.Roots = []RootConfig{{Name: "lnms", Path: "./sample/librenms/", Step: 300}, {Path: "./sample"}}
+	roots, err := setupRoots(config)
+	if err != nil {
+		t.Fatalf("Cannot set up roots. %v", err)
+	}
+	if roots[0].step != 300 || roots[1].step != 10 || roots[1].multiplier != 1 {
+		t.Fatalf("Unexpected root settings. %+v %+v", roots[0], roots[1])
+	}
+
+	root, rel := roots.forTarget("lnms:host:port-id66:INOCTETS")
+	if root != roots[0] || rel != "host:port-id66:INOCTETS" {
+		t.Fatalf("Target should belong to the lnms root. %v %s", root, rel)
+	}
+	if root, _ := roots.forTarget("percent:percent-idle:value"); root != roots[1] {
+		t.Fatalf("Target should belong to the unnamed root. %v", root)
+	}
+	if _, file := roots.fileForTarget("lnms:host:port-id66"); file != "sample/librenms/host/port-id66.rrd" {
+		t.Fatalf("Unexpected file. %s", file)
+	}
+	if target := roots[0].target("sample/librenms/host/port-id66.rrd"); target != "lnms:host:port-id66" {
+		t.Fatalf("Unexpected target. %s", target)
+	}
+}
+
+func TestQueryRoots(t *testing.T) {
+	// The named root shadows the "percent" directory of the unnamed root
+	config := sampleConfig()
+	config.Roots = []RootConfig{
+		{Name: "percent", Path: "./sample/percent", Multiplier: 100},
+		{Path: "./sample"},
+	}
+	s := newTestServer(t, config)
+
+	count := 0
+	for _, item := range s.searchCache.Get() {
+		if strings.HasPrefix(item, "percent:") {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Fatalf("The percent files should be listed once. %v", s.searchCache.Get())
+	}
+	if len(s.searchCache.CFs("percent:percent-idle")) == 0 {
+		t.Fatal("CFs should be keyed by the prefixed target.")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.query))
+	defer ts.Close()
+
+	requestJSON := `{
+	  "range":{
+	    "from":"2016-12-07T22:47:00Z",
+	    "to":"2016-12-08T02:08:00Z"
+	  },
+	  "targets":[
+	    {"target":"*:percent-idle:value","refId":"A"}
+	  ]
+	}`
+	r, err := http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+	var qrs = []QueryResponse{}
+	if err := json.NewDecoder(r.Body).Decode(&qrs); err != nil {
+		t.Fatalf("Error at decoding JSON response. %v", err)
+	}
+	if len(qrs) != 1 || qrs[0].Target != "percent:percent-idle:value" || len(qrs[0].DataPoints) == 0 {
+		t.Fatalf("Only the named root should serve percent-idle. %v", qrs)
+	}
+
+	// The same file read through the unnamed root has the -m multiplier
+	unscaled := s.fetchSeries(seriesJob{root: s.roots[1], filePath: "sample/percent/percent-idle.rrd", ds: "value"},
+		fetchWindow{From: mustParseTime(t, "2016-12-07T22:47:00Z"), To: mustParseTime(t, "2016-12-08T02:08:00Z"), Step: 10 * time.Second})
+	for i, p := range qrs[0].DataPoints {
+		if p[0] != unscaled.DataPoints[i][0]*100 {
+			t.Fatalf("The root multiplier isn't applied. %v %v", p, unscaled.DataPoints[i])
+		}
+	}
+}
+
+func TestSearchCacheMissingRoot(t *testing.T) {
+	config := sampleConfig()
+	config.Roots = []RootConfig{
+		{Name: "missing", Path: filepath.Join(t.TempDir(), "missing")},
+		{Path: "./sample"},
+	}
+	s := newTestServer(t, config)
+
+	if !slices.Contains(s.searchCache.Get(), "percent:percent-idle:value") {
+		t.Fatalf("The files of the other roots should be listed. %v", s.searchCache.Get())
+	}
+}
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("Cannot parse time. %v", err)
+	}
+	return parsed
+}
+
+func TestTargetConfinement(t *testing.T) {
+	config := sampleConfig()
+	config.Server.GlobDepth = 3
+	config.Server.GlobMatches = 1
+	s := newTestServer(t, config)
+
+	for _, pattern := range []string{
+		"..:..:etc:passwd",
+		"percent:..:percent:percent-idle",
+		"percent:{..,x}:percent-idle",
+		"percent::percent-idle",
+		"**:percent-idle",
+		"percent:a/b",
+		"*:*:*:*",
+	} {
+		if err := checkTargetPattern(pattern, 3); err == nil {
+			t.Fatalf("%q should be rejected.", pattern)
+		}
+	}
+	for _, pattern := range []string{"percent:percent-{idle,user}", "a:b:c:d", "librenms:host:poller..old"} {
+		if err := checkTargetPattern(pattern, 3); err != nil {
+			t.Fatalf("%q should be accepted. %v", pattern, err)
+		}
+	}
+
+	if _, err := s.expandTarget("percent:*:value", "", nil); err == nil {
+		t.Fatal("Targets matching more files than the limit should be rejected.")
+	}
+	if jobs, err := s.expandTarget("percent:percent-idle:value", "", nil); err != nil || len(jobs) != 1 {
+		t.Fatalf("Unexpected jobs. %v %v", jobs, err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.query))
+	defer ts.Close()
+	for _, target := range []string{"..:sample:percent:percent-idle:value", "percent:*:value"} {
+		body := `{"range":{"from":"2016-12-07T22:47:00Z","to":"2016-12-08T02:08:00Z"},"targets":[{"target":"` + target + `","refId":"A"}]}`
+		r, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error at an POST request. %v", err)
+		}
+		if r.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s should be a bad request but %d.", target, r.StatusCode)
+		}
+	}
+
+	infoServer := httptest.NewServer(http.HandlerFunc(s.info))
+	defer infoServer.Close()
+	if r, err := http.Get(infoServer.URL + "?target=..:sample:percent:percent-idle"); err != nil || r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Traversal in /info should be a bad request. %v %v", r, err)
+	}
+}
+
+func TestGlobFiles(t *testing.T) {
+	glob := func(rel string) []string {
+		var files []string
+		if err := globFiles("sample", rel, func(filePath string) error {
+			files = append(files, filePath)
+			return nil
+		}); err != nil {
+			t.Fatalf("Cannot glob %s. %v", rel, err)
+		}
+		return files
+	}
+	if files := glob("percent/percent-{idle,user}"); len(files) != 2 || files[0] != "sample/percent/percent-idle.rrd" {
+		t.Fatalf("Unexpected files. %v", files)
+	}
+	if files := glob("*/percent-idle"); len(files) != 1 {
+		t.Fatalf("Unexpected files. %v", files)
+	}
+	// Files deeper than the pattern aren't matched
+	if files := glob("*"); len(files) != 1 || files[0] != "sample/sample.rrd" {
+		t.Fatalf("Unexpected files. %v", files)
+	}
+	if files := glob("nosuchdir/*"); len(files) != 0 {
+		t.Fatalf("Unexpected files. %v", files)
+	}
+
+	// The walk stops at the first error
+	calls := 0
+	err := globFiles("sample", "*/*", func(string) error {
+		calls++
+		return errTooManyMatches
+	})
+	if err != errTooManyMatches || calls != 1 {
+		t.Fatalf("The walk should stop at the first error. %v %d", err, calls)
+	}
+}
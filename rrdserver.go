@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"math"
 	"net/http"
@@ -11,22 +14,20 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/gocarina/gocsv"
+	"github.com/fsnotify/fsnotify"
 	"github.com/mattn/go-zglob"
 	rrdcached "github.com/multiplay/go-rrd"
 	"github.com/ziutek/rrd"
 )
 
-var config Config
 var logger *slog.Logger
-var rrdcachedClient *rrdcached.Client
-var rrdcachedMutex sync.Mutex
 
 func init() {
 	// Initialize logger with a default handler for tests
@@ -40,11 +41,27 @@ func init() {
 type QueryResponse struct {
 	Target     string      `json:"target"`
 	DataPoints [][]float64 `json:"datapoints"`
+	// meta is set on series read from a file, not on expression results
+	meta *seriesMeta
+}
+
+// TableResponse is a table in the SimpleJSON format, returned for targets
+// with "type": "table"
+type TableResponse struct {
+	Columns []TableColumn   `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	Type    string          `json:"type"`
+}
+
+type TableColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
 }
 
 type LsResponse struct {
-	Directories []string `json:"directories"`
-	Files       []string `json:"files"`
+	Directories []string            `json:"directories"`
+	Files       []string            `json:"files"`
+	CFs         map[string][]string `json:"cfs"`
 }
 
 type SearchRequest struct {
@@ -65,31 +82,44 @@ type QueryRequest struct {
 		From string `json:"from"`
 		To   string `json:"to"`
 	} `json:"rangeRaw"`
-	Interval   string `json:"interval"`
-	IntervalMs int64  `json:"intervalMs"`
-	Targets    []struct {
-		Target string `json:"target"`
-		RefID  string `json:"refId"`
-		Hide   bool   `json:"hide"`
-		Type   string `json:"type"`
-	} `json:"targets"`
-	Format        string `json:"format"`
-	MaxDataPoints int64  `json:"maxDataPoints"`
+	Interval      string        `json:"interval"`
+	IntervalMs    int64         `json:"intervalMs"`
+	Targets       []QueryTarget `json:"targets"`
+	Format        string        `json:"format"`
+	MaxDataPoints int64         `json:"maxDataPoints"`
 }
 
+type QueryTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Hide   bool   `json:"hide"`
+	Type   string `json:"type"`
+	CF     string `json:"cf"`
+}
+
+// AnnotationResponse is an annotation returned by /annotations. ID is set
+// for annotations of the writable source, which can be deleted by it.
+// Regions have a TimeEnd.
 type AnnotationResponse struct {
-	Annotation string `json:"annotation"`
-	Time       int64  `json:"time"`
-	Title      string `json:"title"`
-	Tags       string `json:"tags"`
-	Text       string `json:"text"`
+	Annotation string   `json:"annotation"`
+	ID         int64    `json:"id,omitempty"`
+	Time       int64    `json:"time"`
+	TimeEnd    int64    `json:"timeEnd,omitempty"`
+	IsRegion   bool     `json:"isRegion,omitempty"`
+	Title      string   `json:"title"`
+	Tags       []string `json:"tags"`
+	Text       string   `json:"text"`
 }
 
+// AnnotationCSV is an annotation of a source. TimeEnd and ID are optional
+// columns, written by /annotations/events.
 type AnnotationCSV struct {
-	Time  int64  `csv:"time"`
-	Title string `csv:"title"`
-	Tags  string `csv:"tags"`
-	Text  string `csv:"text"`
+	Time    int64  `csv:"time" json:"time"`
+	Title   string `csv:"title" json:"title"`
+	Tags    string `csv:"tags" json:"tags"`
+	Text    string `csv:"text" json:"text"`
+	TimeEnd int64  `csv:"timeEnd" json:"timeEnd"`
+	ID      int64  `csv:"id" json:"id"`
 }
 
 type AnnotationRequest struct {
@@ -102,27 +132,64 @@ type AnnotationRequest struct {
 		To   string `json:"to"`
 	} `json:"rangeRaw"`
 	Annotation struct {
-		Name       string `json:"name"`
-		Datasource string `json:"datasource"`
-		IconColor  string `json:"iconColor"`
-		Enable     bool   `json:"enable"`
-		Query      string `json:"query"`
+		Name       string   `json:"name"`
+		Datasource string   `json:"datasource"`
+		IconColor  string   `json:"iconColor"`
+		Enable     bool     `json:"enable"`
+		Query      string   `json:"query"`
+		Tags       []string `json:"tags"`
+		MatchAny   bool     `json:"matchAny"`
 	} `json:"annotation"`
 }
 
 type Config struct {
-	Server ServerConfig
+	Server      ServerConfig             `yaml:"server"`
+	Roots       []RootConfig             `yaml:"roots"`
+	Paths       []PathConfig             `yaml:"paths"`
+	Annotations []AnnotationSourceConfig `yaml:"annotations"`
+	Templates   []TemplateConfig         `yaml:"templates"`
+	Alerting    AlertingConfig           `yaml:"alerting"`
+	Auth        AuthConfig               `yaml:"auth"`
 }
 
 type ServerConfig struct {
-	RrdPath            string
-	Step               int
-	SearchCache        int64
-	IpAddr             string
-	Port               int
-	AnnotationFilePath string
-	Multiplier         int
-	RrdCached          string
+	RrdPath            string `yaml:"rrdPath"`
+	Step               int    `yaml:"step"`
+	SearchCache        int64  `yaml:"searchCache"`
+	IpAddr             string `yaml:"ipAddr"`
+	Port               int    `yaml:"port"`
+	AnnotationFilePath string `yaml:"annotationFilePath"`
+	Multiplier         int    `yaml:"multiplier"`
+	RrdCached          string `yaml:"rrdCached"`
+	Workers            int    `yaml:"workers"`
+	Watch              bool   `yaml:"watch"`
+	WriteToken         string `yaml:"writeToken"`
+	TLSCert            string `yaml:"tlsCert"`
+	TLSKey             string `yaml:"tlsKey"`
+	TLSClientCA        string `yaml:"tlsClientCA"`
+	GlobDepth          int    `yaml:"globDepth"`
+	GlobMatches        int    `yaml:"globMatches"`
+}
+
+// rrdServer serves a configuration: its settings, the roots they define, the
+// search cache of their files and the state of the alert rules. The server
+// has one; the plugin has one per datasource, which share nothing else.
+type rrdServer struct {
+	config      Config
+	roots       rrdRoots
+	searchCache *SearchCache
+	rules       []*ruleState
+}
+
+// newRRDServer sets up the roots and rules of config, which has been checked
+func newRRDServer(config Config) (*rrdServer, error) {
+	roots, err := setupRoots(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &rrdServer{config: config, roots: roots, searchCache: NewSearchCache(roots)}
+	s.setupRules()
+	return s, nil
 }
 
 type ErrorResponse struct {
@@ -130,127 +197,731 @@ type ErrorResponse struct {
 }
 
 type SearchCache struct {
-	m     sync.Mutex
+	roots rrdRoots
+
+	// update serializes rescans with the changes of single files, which a
+	// rescan that started before them would undo
+	update sync.Mutex
+
+	m sync.Mutex
+	// files holds the data sources and CFs of each file, keyed by the colon
+	// separated path of the file
+	files map[string]searchEntry
+	// items is built from files when dirty
 	items []string
+	dirty bool
+}
+
+type searchEntry struct {
+	dsNames []string
+	cfs     []string
 }
 
-func NewSearchCache() *SearchCache {
-	return &SearchCache{}
+func NewSearchCache(roots rrdRoots) *SearchCache {
+	return &SearchCache{roots: roots, files: map[string]searchEntry{}}
 }
 
 func (w *SearchCache) Get() []string {
 	w.m.Lock()
 	defer w.m.Unlock()
 
+	if w.dirty {
+		fileNames := make([]string, 0, len(w.files))
+		for fName := range w.files {
+			fileNames = append(fileNames, fName)
+		}
+		sort.Strings(fileNames)
+
+		items := []string{}
+		for _, fName := range fileNames {
+			for _, ds := range w.files[fName].dsNames {
+				items = append(items, fName+":"+ds)
+			}
+		}
+		w.items = items
+		w.dirty = false
+	}
 	return w.items
 }
 
-func (w *SearchCache) Update() {
-	newItems := []string{}
+// CFs returns the consolidation functions held by the file named by its
+// colon separated path, e.g. "librenms:host:port-id66".
+func (w *SearchCache) CFs(file string) []string {
+	w.m.Lock()
+	defer w.m.Unlock()
 
-	logger.Info("Updating search cache")
-	err := filepath.Walk(strings.TrimRight(config.Server.RrdPath, "/")+"/",
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+	return w.files[file].cfs
+}
 
-			if info.IsDir() || !strings.Contains(info.Name(), ".rrd") {
-				return nil
-			}
-			rel, _ := filepath.Rel(config.Server.RrdPath, path)
-			fName := strings.Replace(rel, ".rrd", "", 1)
-			fName = strings.Replace(fName, "/", ":", -1)
+// isRRDFile reports whether a file name looks like an RRD file
+func isRRDFile(name string) bool {
+	return strings.Contains(name, ".rrd")
+}
 
-			// Use rrdcached if configured, otherwise direct file access
-			var dsIndex map[string]interface{}
+func newSearchEntry(header *RRDInfo) searchEntry {
+	entry := searchEntry{dsNames: make([]string, 0, len(header.DsIndex)), cfs: header.CFs}
+	for ds := range header.DsIndex {
+		entry.dsNames = append(entry.dsNames, ds)
+	}
+	sort.Slice(entry.dsNames, func(i, j int) bool {
+		return header.DsIndex[entry.dsNames[i]] < header.DsIndex[entry.dsNames[j]]
+	})
+	return entry
+}
+
+// Update rescans all roots. Headers of files that didn't change since the
+// last scan come from the info cache.
+func (w *SearchCache) Update() {
+	w.update.Lock()
+	defer w.update.Unlock()
+
+	started := time.Now()
+	newFiles := map[string]searchEntry{}
+	seen := map[string]bool{}
 
-			if rrdcachedClient != nil {
-				// Use rrdcached client
-				infoRes, err := rrdcachedClient.Info(path)
+	logger.Info("Updating search cache")
+	for _, root := range w.roots {
+		err := filepath.Walk(root.path+"/",
+			func(path string, info os.FileInfo, err error) error {
 				if err != nil {
-					logger.Error("Cannot retrieve information from RRD via rrdcached", "path", path, "error", err)
-					return nil
+					return err
 				}
-				// Parse ds.index from rrdcached Info response
-				dsIndex = make(map[string]interface{})
-				for _, info := range infoRes {
-					if strings.HasPrefix(info.Key, "ds[") && strings.HasSuffix(info.Key, "].index") {
-						dsName := strings.TrimSuffix(strings.TrimPrefix(info.Key, "ds["), "].index")
-						dsIndex[dsName] = info.Value
-					}
+
+				if info.IsDir() || !isRRDFile(info.Name()) || !w.roots.owns(root, path) {
+					return nil
 				}
-			} else {
-				// Use direct file access
-				infoRes, err := rrd.Info(path)
+				seen[path] = true
+
+				header, err := root.cachedInfo(path)
 				if err != nil {
 					logger.Error("Cannot retrieve information from RRD file", "path", path, "error", err)
 					return nil
 				}
-				dsIndex = infoRes["ds.index"].(map[string]interface{})
+				newFiles[root.target(path)] = newSearchEntry(header)
+
+				return nil
+			})
+
+		if err != nil {
+			// The other roots are still searchable
+			logger.Error("Error walking path", "root", root.name, "path", root.path, "error", err)
+			continue
+		}
+	}
+	infoCache.retain(seen)
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.files = newFiles
+	w.dirty = true
+	searchCacheFiles.Set(float64(len(newFiles)))
+	searchCacheUpdateDuration.Set(time.Since(started).Seconds())
+	searchCacheLastUpdate.SetToCurrentTime()
+	logger.Info("Finished updating search cache", "files", len(newFiles))
+}
+
+// UpdateFile reads the header of one file of root again, or removes the file
+// if it doesn't exist anymore
+func (w *SearchCache) UpdateFile(root *rrdRoot, path string) {
+	if !w.roots.owns(root, path) {
+		return
+	}
+	w.update.Lock()
+	defer w.update.Unlock()
+	fName := root.target(path)
+
+	var entry searchEntry
+	header, err := root.cachedInfo(path)
+	if err == nil {
+		entry = newSearchEntry(header)
+	} else if !os.IsNotExist(err) {
+		logger.Error("Cannot retrieve information from RRD file", "path", path, "error", err)
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	if err != nil {
+		infoCache.forget(path)
+		if _, ok := w.files[fName]; !ok {
+			return
+		}
+		delete(w.files, fName)
+	} else {
+		w.files[fName] = entry
+	}
+	w.dirty = true
+	searchCacheFiles.Set(float64(len(w.files)))
+}
+
+// HasFile reports whether the file named by its colon separated path is known
+func (w *SearchCache) HasFile(file string) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	_, ok := w.files[file]
+	return ok
+}
+
+// RemoveDir removes the files of a directory of root that was deleted or
+// renamed
+func (w *SearchCache) RemoveDir(root *rrdRoot, path string) {
+	prefix := root.target(path) + ":"
+	w.update.Lock()
+	defer w.update.Unlock()
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	for fName := range w.files {
+		if strings.HasPrefix(fName, prefix) {
+			delete(w.files, fName)
+			w.dirty = true
+		}
+	}
+	searchCacheFiles.Set(float64(len(w.files)))
+}
+
+// RRDInfo holds the parts of an RRD header the server works with
+type RRDInfo struct {
+	Step        time.Duration
+	LastUpdate  time.Time
+	DsIndex     map[string]int
+	DataSources map[string]*RRDDataSource
+	RRAs        []*RRDArchive
+	CFs         []string
+}
+
+// RRDDataSource is the definition of a data source. Min and Max are NaN when
+// the DS is unbounded ("U").
+type RRDDataSource struct {
+	Type      string
+	Heartbeat int
+	Min       float64
+	Max       float64
+}
+
+// RRDArchive is the definition of an RRA
+type RRDArchive struct {
+	CF        string
+	Rows      int
+	PdpPerRow int
+	XFF       float64
+}
+
+// dataSource returns the definition of a data source, adding it if needed
+func (info *RRDInfo) dataSource(name string) *RRDDataSource {
+	ds, ok := info.DataSources[name]
+	if !ok {
+		ds = &RRDDataSource{Min: math.NaN(), Max: math.NaN()}
+		info.DataSources[name] = ds
+	}
+	return ds
+}
+
+// archive returns the definition of the i-th RRA, adding it if needed
+func (info *RRDInfo) archive(i int) *RRDArchive {
+	for len(info.RRAs) <= i {
+		info.RRAs = append(info.RRAs, &RRDArchive{})
+	}
+	return info.RRAs[i]
+}
+
+// rrdInfo reads the header of an RRD file, using rrdcached if configured
+func (root *rrdRoot) rrdInfo(filePath string) (*RRDInfo, error) {
+	info := &RRDInfo{DsIndex: map[string]int{}, DataSources: map[string]*RRDDataSource{}}
+
+	if root.cached() {
+		var infoRes []*rrdcached.Info
+		err := root.rrdcached.with(func(client *rrdcached.Client) (err error) {
+			infoRes, err = client.Info(filePath)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		// rrdcached returns flat "ds[name].field" and "rra[N].field" keys
+		for _, i := range infoRes {
+			intValue, _ := i.Value.(int64)
+			floatValue, _ := i.Value.(float64)
+			stringValue, _ := i.Value.(string)
+			switch {
+			case i.Key == "step":
+				info.Step = time.Duration(intValue) * time.Second
+			case i.Key == "last_update":
+				info.LastUpdate = time.Unix(intValue, 0)
+			case strings.HasPrefix(i.Key, "ds["):
+				dsName, field, _ := strings.Cut(strings.TrimPrefix(i.Key, "ds["), "].")
+				switch field {
+				case "index":
+					info.DsIndex[dsName] = int(intValue)
+				case "type":
+					info.dataSource(dsName).Type = stringValue
+				case "minimal_heartbeat":
+					info.dataSource(dsName).Heartbeat = int(intValue)
+				case "min":
+					info.dataSource(dsName).Min = floatValue
+				case "max":
+					info.dataSource(dsName).Max = floatValue
+				}
+			case strings.HasPrefix(i.Key, "rra["):
+				index, field, _ := strings.Cut(strings.TrimPrefix(i.Key, "rra["), "].")
+				n, err := strconv.Atoi(index)
+				if err != nil {
+					continue
+				}
+				switch field {
+				case "cf":
+					info.archive(n).CF = stringValue
+				case "rows":
+					info.archive(n).Rows = int(intValue)
+				case "pdp_per_row":
+					info.archive(n).PdpPerRow = int(intValue)
+				case "xff":
+					info.archive(n).XFF = floatValue
+				}
 			}
+		}
+		info.CFs = archiveCFs(info.RRAs)
+		return info, nil
+	}
 
-			for ds := range dsIndex {
-				newItems = append(newItems, fName+":"+ds)
+	infoRes, err := rrd.Info(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if val, ok := infoRes["step"].(uint); ok {
+		info.Step = time.Duration(val) * time.Second
+	}
+	if val, ok := infoRes["last_update"].(uint); ok {
+		info.LastUpdate = time.Unix(int64(val), 0)
+	}
+	// Per-DS values are maps keyed by the DS name, per-RRA values are slices
+	dsValues := func(key string, f func(ds *RRDDataSource, value interface{})) {
+		values, _ := infoRes[key].(map[string]interface{})
+		for dsName, value := range values {
+			f(info.dataSource(dsName), value)
+		}
+	}
+	rraValues := func(key string, f func(rra *RRDArchive, value interface{})) {
+		values, _ := infoRes[key].([]interface{})
+		for i, value := range values {
+			f(info.archive(i), value)
+		}
+	}
+	if dsIndex, ok := infoRes["ds.index"].(map[string]interface{}); ok {
+		for ds, idx := range dsIndex {
+			if val, ok := idx.(uint); ok {
+				info.DsIndex[ds] = int(val)
 			}
+		}
+	}
+	dsValues("ds.type", func(ds *RRDDataSource, value interface{}) { ds.Type, _ = value.(string) })
+	dsValues("ds.minimal_heartbeat", func(ds *RRDDataSource, value interface{}) {
+		val, _ := value.(uint)
+		ds.Heartbeat = int(val)
+	})
+	dsValues("ds.min", func(ds *RRDDataSource, value interface{}) { ds.Min, _ = value.(float64) })
+	dsValues("ds.max", func(ds *RRDDataSource, value interface{}) { ds.Max, _ = value.(float64) })
+	rraValues("rra.cf", func(rra *RRDArchive, value interface{}) { rra.CF, _ = value.(string) })
+	rraValues("rra.rows", func(rra *RRDArchive, value interface{}) {
+		val, _ := value.(uint)
+		rra.Rows = int(val)
+	})
+	rraValues("rra.pdp_per_row", func(rra *RRDArchive, value interface{}) {
+		val, _ := value.(uint)
+		rra.PdpPerRow = int(val)
+	})
+	rraValues("rra.xff", func(rra *RRDArchive, value interface{}) { rra.XFF, _ = value.(float64) })
+	info.CFs = archiveCFs(info.RRAs)
+	return info, nil
+}
 
+// archiveCFs returns the CFs of the RRAs in order of first appearance
+func archiveCFs(rras []*RRDArchive) []string {
+	var cfs []string
+	for _, rra := range rras {
+		if rra.CF != "" && !hasCF(cfs, rra.CF) {
+			cfs = append(cfs, rra.CF)
+		}
+	}
+	return cfs
+}
+
+// consolidationFunctions lists the CFs that can be requested for a target
+var consolidationFunctions = []string{"AVERAGE", "MIN", "MAX", "LAST"}
+
+// defaultCF picks the CF used when a target doesn't name one: AVERAGE if
+// the file holds it, otherwise the first CF found in the file
+func defaultCF(cfs []string) string {
+	for _, cf := range cfs {
+		if cf == "AVERAGE" {
+			return cf
+		}
+	}
+	if len(cfs) > 0 {
+		return cfs[0]
+	}
+	return "AVERAGE"
+}
+
+// splitTargetCF splits an optional "@CF" suffix off a target, e.g.
+// "host:port-eth0:traffic_in@MAX"
+func splitTargetCF(target string) (string, string) {
+	at := strings.LastIndex(target, "@")
+	if at <= 0 {
+		return target, ""
+	}
+	return target[:at], strings.ToUpper(target[at+1:])
+}
+
+func hasCF(cfs []string, cf string) bool {
+	for _, c := range cfs {
+		if c == cf {
+			return true
+		}
+	}
+	return false
+}
+
+// queryStep works out the fetch resolution for a query request. It is the
+// coarsest of the configured step, the panel interval and the step needed to
+// fit the range into maxDataPoints, so that rrdtool picks the coarsest RRA
+// that still fills the panel.
+func (s *rrdServer) queryStep(queryRequest QueryRequest, from, to time.Time) time.Duration {
+	step := time.Duration(s.config.Server.Step) * time.Second
+
+	if interval := time.Duration(queryRequest.IntervalMs) * time.Millisecond; interval > step {
+		step = interval
+	}
+
+	if queryRequest.MaxDataPoints > 0 && to.After(from) {
+		pointStep := to.Sub(from) / time.Duration(queryRequest.MaxDataPoints)
+		if pointStep > step {
+			step = pointStep
+		}
+	}
+
+	return step.Truncate(time.Second)
+}
+
+// consolidate merges values into one using the consolidation function,
+// ignoring unknown (NaN) values. It returns NaN if all values are unknown.
+func consolidate(values []float64, cf string) float64 {
+	result := math.NaN()
+	count := 0
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		switch {
+		case count == 0:
+			result = v
+		case cf == "MIN":
+			result = math.Min(result, v)
+		case cf == "MAX":
+			result = math.Max(result, v)
+		case cf == "LAST":
+			result = v
+		default:
+			result += v
+		}
+		count++
+	}
+	if cf != "MIN" && cf != "MAX" && cf != "LAST" && count > 0 {
+		result /= float64(count)
+	}
+	return result
+}
+
+// fetchWindow is the time range and resolution a query is fetched with
+type fetchWindow struct {
+	From          time.Time
+	To            time.Time
+	Step          time.Duration
+	MaxDataPoints int64
+}
+
+// seriesJob is one RRD file matched by a target
+type seriesJob struct {
+	root     *rrdRoot
+	filePath string
+	ds       string
+	// cf is the requested consolidation function, empty for the file's default
+	cf string
+}
+
+// expandTarget resolves the wildcards in a "path:to:file:ds" target into
+// one job per matching RRD file the user may read, across all roots. Targets
+// that could leave the roots and wildcards matching more than
+// config.Server.GlobMatches files are rejected.
+func (s *rrdServer) expandTarget(targetPath, cf string, access pathAccess) ([]seriesJob, error) {
+	ds := targetPath[strings.LastIndex(targetPath, ":")+1 : len(targetPath)]
+	rrdDsRep := regexp.MustCompile(`:` + regexp.QuoteMeta(ds) + `$`)
+	filePattern := rrdDsRep.ReplaceAllString(targetPath, "")
+	if err := checkTargetPattern(filePattern, s.config.Server.GlobDepth); err != nil {
+		globExpansions.WithLabelValues("rejected").Inc()
+		return nil, err
+	}
+
+	limit := s.config.Server.GlobMatches
+	var jobs []seriesJob
+	for _, root := range s.roots {
+		rel, ok := root.relative(filePattern)
+		if !ok {
+			continue
+		}
+		err := globFiles(root.path, strings.Replace(rel, ":", "/", -1), func(filePath string) error {
+			if root.contains(filePath) && s.roots.owns(root, filePath) && access.allows(root.target(filePath)) {
+				jobs = append(jobs, seriesJob{root: root, filePath: filePath, ds: ds, cf: cf})
+				if limit > 0 && len(jobs) > limit {
+					return errTooManyMatches
+				}
+			}
 			return nil
 		})
+		if errors.Is(err, errTooManyMatches) {
+			globExpansions.WithLabelValues("rejected").Inc()
+			return nil, fmt.Errorf("target %q matches more than %d files", targetPath, limit)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot expand target %q: %w", targetPath, err)
+		}
+	}
+	globExpansions.WithLabelValues("ok").Inc()
+	globMatchedFiles.Observe(float64(len(jobs)))
+	return jobs, nil
+}
+
+// errTooManyMatches stops a glob walk once more files match than allowed
+var errTooManyMatches = errors.New("too many matches")
+
+// globFiles calls found for each RRD file in dir matching the "path/to/file"
+// pattern rel, with the wildcards of zglob but no "**". Unlike zglob.Glob it
+// walks no deeper than the pattern, and it stops at the first error found
+// returns. Directories removed during the walk are skipped.
+func globFiles(dir, rel string, found func(filePath string) error) error {
+	pattern := dir + "/" + rel + ".rrd"
+	if !strings.ContainsAny(rel, "*{") {
+		if _, err := os.Stat(pattern); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		return found(pattern)
+	}
 
+	z, err := zglob.New(pattern)
 	if err != nil {
-		logger.Error("Error walking path", "error", err)
-		return
+		return err
+	}
+	// The walk starts below the segments without wildcards
+	segments := strings.Split(rel, "/")
+	static := 0
+	for static < len(segments)-1 && !strings.ContainsAny(segments[static], "*{") {
+		static++
 	}
+	start := filepath.Join(append([]string{dir}, segments[:static]...)...)
+	depth := len(segments) - static
 
-	w.m.Lock()
-	defer w.m.Unlock()
-	w.items = newItems
-	logger.Info("Finished updating search cache", "items", len(newItems))
+	// Like zglob, symlinks to directories are only followed at the start
+	var walk func(dirPath string, level int) error
+	walk = func(dirPath string, level int) error {
+		entries, err := os.ReadDir(dirPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		for _, entry := range entries {
+			entryPath := filepath.Join(dirPath, entry.Name())
+			if entry.IsDir() {
+				if level < depth {
+					if err := walk(entryPath, level+1); err != nil {
+						return err
+					}
+				}
+			} else if level == depth && z.Match(filepath.ToSlash(entryPath)) {
+				if err := found(entryPath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	info, err := os.Stat(start)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return walk(start, 1)
+}
+
+// fetchAllSeries fetches jobs on a pool of at most config.Server.Workers
+// goroutines. It returns one series per job, in job order, with nil for the
+// jobs that couldn't be fetched.
+func (s *rrdServer) fetchAllSeries(jobs []seriesJob, window fetchWindow) []*QueryResponse {
+	workers := s.config.Server.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	series := make([]*QueryResponse, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range next {
+				series[idx] = s.fetchSeries(jobs[idx], window)
+			}
+		}()
+	}
+	for idx := range jobs {
+		next <- idx
+	}
+	close(next)
+	wg.Wait()
+
+	return series
 }
 
-var searchCache *SearchCache = NewSearchCache()
+// compactSeries drops the series that couldn't be fetched
+func compactSeries(series []*QueryResponse) []QueryResponse {
+	result := []QueryResponse{}
+	for _, s := range series {
+		if s != nil {
+			result = append(result, *s)
+		}
+	}
+	return result
+}
 
-// recreateRRDCachedClient recreates the rrdcached client connection
-func recreateRRDCachedClient() error {
-	rrdcachedMutex.Lock()
-	defer rrdcachedMutex.Unlock()
+// fetchSeries reads the data points of one RRD file. It returns nil if the
+// file cannot be read or doesn't have the data source or CF.
+func (s *rrdServer) fetchSeries(job seriesJob, window fetchWindow) *QueryResponse {
+	root, filePath, ds, cf := job.root, job.filePath, job.ds, job.cf
+	from, to := window.From, window.To
+	step := window.Step
+	if rootStep := time.Duration(root.step) * time.Second; rootStep > step {
+		step = rootStep
+	}
 
-	if rrdcachedClient != nil {
-		rrdcachedClient.Close()
-		rrdcachedClient = nil
+	points := make([][]float64, 0)
+	if _, err := os.Stat(filePath); err != nil {
+		logger.Warn("File does not exist", "path", filePath)
+		return nil
 	}
 
-	var err error
-	if strings.HasPrefix(config.Server.RrdCached, "unix:") {
-		socketPath := strings.TrimPrefix(config.Server.RrdCached, "unix:")
-		rrdcachedClient, err = rrdcached.NewClient(socketPath, rrdcached.Unix)
-	} else {
-		rrdcachedClient, err = rrdcached.NewClient(config.Server.RrdCached)
+	info, err := root.cachedInfo(filePath)
+	if err != nil {
+		logger.Error("Cannot retrieve information from RRD file", "path", filePath, "error", err)
+		return nil
+	}
+
+	fileCF := cf
+	if fileCF == "" {
+		fileCF = defaultCF(info.CFs)
+	} else if !hasCF(info.CFs, fileCF) {
+		logger.Warn("RRD file has no archive for the consolidation function", "path", filePath, "cf", fileCF)
+		return nil
+	}
+
+	if to.After(info.LastUpdate) && info.LastUpdate.After(from) {
+		to = info.LastUpdate
 	}
 
+	started, backend := time.Now(), root.backend()
+	fetchData, dsNames, fetchStart, fetchStep, rowCnt, err := root.fetchRRDData(filePath, fileCF, from, to, step)
+	observeFetch(backend, started, err)
 	if err != nil {
-		logger.Error("Failed to reconnect to rrdcached", "daemon", config.Server.RrdCached, "error", err)
-		return err
+		logger.Error("Cannot retrieve time series data from RRD file", "path", filePath, "error", err)
+		return nil
+	}
+
+	dsIndex := -1
+	for i, name := range dsNames {
+		if name == ds {
+			dsIndex = i
+			break
+		}
+	}
+	if dsIndex < 0 {
+		logger.Warn("Data source does not exist in RRD file", "path", filePath, "ds", ds)
+		return nil
 	}
 
-	logger.Info("Reconnected to rrdcached", "daemon", config.Server.RrdCached)
-	return nil
+	extractedTarget := root.target(filePath) + ":" + ds
+	multiplier := s.config.multiplierFor(extractedTarget, root.multiplier)
+
+	// The last point is likely to contain wrong data (mostly a big number)
+	// rowCnt-1 is for ignoring the last point (temporary solution)
+	rows := rowCnt - 1
+
+	// Merge rows when the RRA is still finer than maxDataPoints allows
+	rowsPerPoint := 1
+	if window.MaxDataPoints > 0 && int64(rows) > window.MaxDataPoints {
+		rowsPerPoint = int((int64(rows) + window.MaxDataPoints - 1) / window.MaxDataPoints)
+	}
+
+	for i := 0; i < rows; i += rowsPerPoint {
+		values := make([]float64, 0, rowsPerPoint)
+		for j := i; j < i+rowsPerPoint && j < rows; j++ {
+			if dsIndex < len(fetchData[j]) {
+				values = append(values, fetchData[j][dsIndex])
+			}
+		}
+		value := consolidate(values, fileCF)
+		if !math.IsNaN(value) {
+			timestamp := fetchStart.Add(time.Duration(i) * fetchStep)
+			product := multiplier * value
+			points = append(points, []float64{product, float64(timestamp.Unix()) * 1000})
+		}
+	}
+
+	meta := &seriesMeta{
+		labels: frameLabels(extractedTarget, cf),
+		unit:   s.config.unitFor(extractedTarget),
+		min:    math.NaN(),
+		max:    math.NaN(),
+	}
+	if dsInfo, ok := info.DataSources[ds]; ok {
+		meta.min, meta.max = multiplier*dsInfo.Min, multiplier*dsInfo.Max
+		if meta.min > meta.max {
+			meta.min, meta.max = meta.max, meta.min
+		}
+	}
+
+	if cf != "" {
+		extractedTarget += "@" + cf
+	}
+	return &QueryResponse{Target: extractedTarget, DataPoints: points, meta: meta}
 }
 
 // fetchRRDData fetches data from RRD file, using rrdcached if configured
-func fetchRRDData(filePath, cf string, start, end time.Time, step time.Duration) ([][]float64, []string, time.Time, time.Duration, int, error) {
-	if rrdcachedClient != nil {
+func (root *rrdRoot) fetchRRDData(filePath, cf string, start, end time.Time, step time.Duration) ([][]float64, []string, time.Time, time.Duration, int, error) {
+	if root.cached() {
 		// Use rrdcached client with retry logic
 		startUnix := start.Unix()
 		endUnix := end.Unix()
 
 		// Flush the file first to ensure we get latest data
 		// This is important when WRITE_TIMEOUT is high
-		flushErr := rrdcachedClient.Flush(filePath)
+		flushErr := root.rrdcached.with(func(client *rrdcached.Client) error {
+			return client.Flush(filePath)
+		})
 		if flushErr != nil {
 			logger.Warn("Failed to flush RRD file before fetch", "path", filePath, "error", flushErr)
 		}
 
+		// rrdcached's FETCH has no resolution argument, so step is not used
+		// here and the caller consolidates the rows instead
 		var err error
 		var fetch *rrdcached.Fetch
 
@@ -259,10 +930,14 @@ func fetchRRDData(filePath, cf string, start, end time.Time, step time.Duration)
 			if attempt > 0 {
 				backoff := time.Duration(attempt*attempt) * time.Second
 				logger.Warn("Retrying rrdcached fetch", "attempt", attempt+1, "backoff", backoff, "path", filePath)
+				rrdcachedRetries.WithLabelValues(root.rrdcached.address).Inc()
 				time.Sleep(backoff)
 			}
 
-			fetch, err = rrdcachedClient.Fetch(filePath, cf, startUnix, endUnix)
+			err = root.rrdcached.with(func(client *rrdcached.Client) (err error) {
+				fetch, err = client.Fetch(filePath, cf, startUnix, endUnix)
+				return err
+			})
 			if err == nil {
 				break
 			}
@@ -272,7 +947,7 @@ func fetchRRDData(filePath, cf string, start, end time.Time, step time.Duration)
 			// If timeout or connection error, try recreating the connection
 			if strings.Contains(err.Error(), "timeout") || strings.Contains(err.Error(), "connection") {
 				logger.Warn("Recreating rrdcached connection due to timeout")
-				if recreateErr := recreateRRDCachedClient(); recreateErr == nil {
+				if recreateErr := root.rrdcached.reconnect(); recreateErr == nil {
 					// Successfully reconnected, continue to next retry
 					continue
 				}
@@ -320,6 +995,10 @@ func fetchRRDData(filePath, cf string, start, end time.Time, step time.Duration)
 }
 
 func respondJSON(w http.ResponseWriter, result interface{}) {
+	respondJSONStatus(w, http.StatusOK, result)
+}
+
+func respondJSONStatus(w http.ResponseWriter, status int, result interface{}) {
 	json, err := json.Marshal(result)
 	if err != nil {
 		logger.Error("Cannot convert response data into JSON", "error", err)
@@ -330,6 +1009,7 @@ func respondJSON(w http.ResponseWriter, result interface{}) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
 	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,HEAD,OPTIONS")
+	w.WriteHeader(status)
 	w.Write([]byte(json))
 }
 
@@ -338,7 +1018,7 @@ func hello(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, result)
 }
 
-func ls(w http.ResponseWriter, r *http.Request) {
+func (s *rrdServer) ls(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "OPTIONS" {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
@@ -369,7 +1049,7 @@ func ls(w http.ResponseWriter, r *http.Request) {
 	dirSet := make(map[string]bool)
 	fileSet := make(map[string]bool)
 
-	for _, path := range searchCache.Get() {
+	for _, path := range s.accessFor(r).searchItems(s.searchCache) {
 		// Remove datasource (everything after last colon)
 		lastColon := strings.LastIndex(path, ":")
 		if lastColon <= 0 {
@@ -403,19 +1083,22 @@ func ls(w http.ResponseWriter, r *http.Request) {
 	}
 
 	files := make([]string, 0, len(fileSet))
+	cfs := make(map[string][]string, len(fileSet))
 	for file := range fileSet {
 		files = append(files, file)
+		cfs[file] = s.searchCache.CFs(prefix + file)
 	}
 
 	result := LsResponse{
 		Directories: directories,
 		Files:       files,
+		CFs:         cfs,
 	}
 
 	respondJSON(w, result)
 }
 
-func search(w http.ResponseWriter, r *http.Request) {
+func (s *rrdServer) search(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var searchRequest SearchRequest
 	err := decoder.Decode(&searchRequest)
@@ -431,17 +1114,24 @@ func search(w http.ResponseWriter, r *http.Request) {
 	var result = []string{}
 
 	if target != "" {
-		for _, path := range searchCache.Get() {
+		for _, path := range s.accessFor(r).searchItems(s.searchCache) {
 			if strings.Contains(path, target) {
 				result = append(result, path)
 			}
+			// Offer the CFs other than the default one as "path@CF" targets
+			cfs := s.searchCache.CFs(path[:strings.LastIndex(path, ":")])
+			for _, cf := range cfs {
+				if cf != defaultCF(cfs) && strings.Contains(path+"@"+cf, target) {
+					result = append(result, path+"@"+cf)
+				}
+			}
 		}
 	}
 
 	respondJSON(w, result)
 }
 
-func query(w http.ResponseWriter, r *http.Request) {
+func (s *rrdServer) query(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "OPTIONS" {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
@@ -461,160 +1151,236 @@ func query(w http.ResponseWriter, r *http.Request) {
 
 	from, _ := time.Parse(time.RFC3339Nano, queryRequest.Range.From)
 	to, _ := time.Parse(time.RFC3339Nano, queryRequest.Range.To)
+	step := s.queryStep(queryRequest, from, to)
 
-	var result []QueryResponse
-	for _, target := range queryRequest.Targets {
-		ds := target.Target[strings.LastIndex(target.Target, ":")+1 : len(target.Target)]
-		rrdDsRep := regexp.MustCompile(`:` + ds + `$`)
-		fileSearchPath := rrdDsRep.ReplaceAllString(target.Target, "")
-		fileSearchPath = strings.TrimRight(config.Server.RrdPath, "/") + "/" + strings.Replace(fileSearchPath, ":", "/", -1) + ".rrd"
-
-		fileNameArray, _ := zglob.Glob(fileSearchPath)
-		for _, filePath := range fileNameArray {
-			points := make([][]float64, 0)
-			if _, err = os.Stat(filePath); err != nil {
-				logger.Warn("File does not exist", "path", filePath)
-				continue
-			}
-
-			// Get info using appropriate method
-			var lastUpdate time.Time
-			var dsIndex int
+	window := fetchWindow{From: from, To: to, Step: step, MaxDataPoints: queryRequest.MaxDataPoints}
 
-			if rrdcachedClient != nil {
-				// Use rrdcached client for Info
-				infoRes, err := rrdcachedClient.Info(filePath)
-				if err != nil {
-					logger.Error("Cannot retrieve information from RRD via rrdcached", "path", filePath, "error", err)
-					continue
-				}
-				// Parse last_update and ds.index from rrdcached Info response
-				for _, info := range infoRes {
-					if info.Key == "last_update" {
-						if val, ok := info.Value.(int64); ok {
-							lastUpdate = time.Unix(val, 0)
-						}
-					}
-					if strings.HasPrefix(info.Key, "ds["+ds+"].index") {
-						if val, ok := info.Value.(int64); ok {
-							dsIndex = int(val)
-						}
-					}
-				}
-			} else {
-				// Use direct file access for Info
-				infoRes, err := rrd.Info(filePath)
-				if err != nil {
-					logger.Error("Cannot retrieve information from RRD file", "path", filePath, "error", err)
-					continue
-				}
-				lastUpdate = time.Unix(int64(infoRes["last_update"].(uint)), 0)
-				dsIndex = int(infoRes["ds.index"].(map[string]interface{})[ds].(uint))
-			}
-
-			if to.After(lastUpdate) && lastUpdate.After(from) {
-				to = lastUpdate
-			}
-
-			fetchData, dsNames, fetchStart, fetchStep, rowCnt, err := fetchRRDData(filePath, "AVERAGE", from, to, time.Duration(config.Server.Step)*time.Second)
-			if err != nil {
-				logger.Error("Cannot retrieve time series data from RRD file", "path", filePath, "error", err)
-				continue
-			}
-
-			// Find dsIndex if we don't have it yet (rrdcached path)
-			if rrdcachedClient != nil && dsIndex == 0 {
-				for i, name := range dsNames {
-					if name == ds {
-						dsIndex = i
-						break
-					}
-				}
-			}
+	targetSeries, err := s.evalTargets(queryRequest.Targets, window, s.accessFor(r))
+	if err != nil {
+		logger.Error("Cannot evaluate query targets", "error", err)
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-			timestamp := fetchStart
-			// The last point is likely to contain wrong data (mostly a big number)
-			// rowCnt-1 is for ignoring the last point (temporary solution)
-			for i := 0; i < rowCnt-1; i++ {
-				if dsIndex < len(fetchData[i]) {
-					value := fetchData[i][dsIndex]
-					if !math.IsNaN(value) {
-						product := float64(config.Server.Multiplier) * value
-						points = append(points, []float64{product, float64(timestamp.Unix()) * 1000})
-					}
-				}
-				timestamp = timestamp.Add(fetchStep)
+	// Hidden targets are only fetched to be referenced by expressions
+	result := []interface{}{}
+	for i, target := range queryRequest.Targets {
+		if target.Hide {
+			continue
+		}
+		if target.Type == "table" || (target.Type == "" && queryRequest.Format == "table") {
+			result = append(result, seriesTable(targetSeries[i]))
+			continue
+		}
+		if target.Type == "frames" || (target.Type == "" && queryRequest.Format == "frames") {
+			for _, series := range targetSeries[i] {
+				result = append(result, seriesFrame(target.RefID, series))
 			}
-
-			extractedTarget := strings.Replace(filePath, ".rrd", "", -1)
-			extractedTarget = strings.Replace(extractedTarget, config.Server.RrdPath, "", -1)
-			extractedTarget = strings.Replace(extractedTarget, "/", ":", -1) + ":" + ds
-			result = append(result, QueryResponse{Target: extractedTarget, DataPoints: points})
+			continue
+		}
+		for _, series := range targetSeries[i] {
+			result = append(result, series)
 		}
 	}
 	respondJSON(w, result)
 }
 
-func annotations(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "OPTIONS" {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
-		w.Header().Set("Access-Control-Allow-Methods", "POST")
-		w.Write(nil)
-		return
+// evalTargets returns the series of each target. All path targets are
+// fetched together, then the expressions are evaluated in order. Expressions
+// can reference the refId of any path target and of earlier expressions.
+// Only the files access allows are fetched. Empty targets, which Grafana
+// sends for new query rows, have no series.
+func (s *rrdServer) evalTargets(targets []QueryTarget, window fetchWindow, access pathAccess) ([][]QueryResponse, error) {
+	var jobs []seriesJob
+	jobCounts := make([]int, len(targets))
+	for i, target := range targets {
+		if isExpression(target.Target) || strings.TrimSpace(target.Target) == "" {
+			continue
+		}
+
+		targetPath, cf := splitTargetCF(target.Target)
+		if cf == "" {
+			cf = strings.ToUpper(target.CF)
+		}
+		if cf != "" && !hasCF(consolidationFunctions, cf) {
+			return nil, fmt.Errorf("unknown consolidation function %s in %q", cf, target.Target)
+		}
+
+		targetJobs, err := s.expandTarget(targetPath, cf, access)
+		if err != nil {
+			return nil, err
+		}
+		jobCounts[i] = len(targetJobs)
+		jobs = append(jobs, targetJobs...)
 	}
+	fetched := s.fetchAllSeries(jobs, window)
 
-	if config.Server.AnnotationFilePath == "" {
-		result := ErrorResponse{Message: "Not configured"}
-		respondJSON(w, result)
-	} else {
-		decoder := json.NewDecoder(r.Body)
-		var annotationRequest AnnotationRequest
-		err := decoder.Decode(&annotationRequest)
-		defer r.Body.Close()
+	env := &exprEnv{server: s, refs: map[string][]QueryResponse{}, window: window, access: access}
+	targetSeries := make([][]QueryResponse, len(targets))
+	for i, target := range targets {
+		if isExpression(target.Target) {
+			continue
+		}
+		targetSeries[i] = compactSeries(fetched[:jobCounts[i]])
+		fetched = fetched[jobCounts[i]:]
+		if target.RefID != "" {
+			env.refs[target.RefID] = targetSeries[i]
+		}
+	}
+	for i, target := range targets {
+		if !isExpression(target.Target) || strings.TrimSpace(target.Target) == "" {
+			continue
+		}
+		series, err := evalExpression(target.Target, env)
 		if err != nil {
-			logger.Error("Cannot decode annotation request", "error", err)
-			result := ErrorResponse{Message: "Cannot decode the request"}
-			respondJSON(w, result)
-		} else {
-			csvFile, err := os.OpenFile(config.Server.AnnotationFilePath, os.O_RDONLY, os.ModePerm)
-			if err != nil {
-				logger.Error("Cannot open annotations CSV file", "path", config.Server.AnnotationFilePath, "error", err)
-			}
-			defer csvFile.Close()
-			annots := []*AnnotationCSV{}
+			return nil, fmt.Errorf("cannot evaluate expression %q: %w", target.Target, err)
+		}
+		targetSeries[i] = series
+		if target.RefID != "" {
+			env.refs[target.RefID] = series
+		}
+	}
+	return targetSeries, nil
+}
 
-			if err := gocsv.UnmarshalFile(csvFile, &annots); err != nil {
-				logger.Error("Cannot unmarshal annotations CSV file", "error", err)
-			}
+// tableColumns are the columns of a table target, which has a row per series
+var tableColumns = []TableColumn{
+	{Text: "Target", Type: "string"},
+	{Text: "Time", Type: "time"},
+	{Text: "Last", Type: "number"},
+	{Text: "Min", Type: "number"},
+	{Text: "Max", Type: "number"},
+	{Text: "Avg", Type: "number"},
+}
 
-			result := []AnnotationResponse{}
-			from, _ := time.Parse(time.RFC3339Nano, annotationRequest.Range.From)
-			to, _ := time.Parse(time.RFC3339Nano, annotationRequest.Range.To)
-			for _, a := range annots {
-				if (from.Unix()*1000) <= a.Time && a.Time <= (to.Unix()*1000) {
-					result = append(result, AnnotationResponse{Annotation: "annotation", Time: a.Time, Title: a.Title, Tags: a.Tags, Text: a.Text})
-				}
+// seriesTable summarizes each series over the range: the time and value of
+// its last point, and its min, max and average. Series without points have
+// null values.
+func seriesTable(series []QueryResponse) TableResponse {
+	rows := make([][]interface{}, 0, len(series))
+	for _, s := range series {
+		row := []interface{}{s.Target, nil, nil, nil, nil, nil}
+		if n := len(s.DataPoints); n > 0 {
+			values := make([]float64, n)
+			for i, p := range s.DataPoints {
+				values[i] = p[0]
 			}
-			respondJSON(w, result)
+			row[1] = int64(s.DataPoints[n-1][1])
+			row[2] = s.DataPoints[n-1][0]
+			row[3] = consolidate(values, "MIN")
+			row[4] = consolidate(values, "MAX")
+			row[5] = consolidate(values, "AVERAGE")
 		}
+		rows = append(rows, row)
 	}
+	return TableResponse{Columns: tableColumns, Rows: rows, Type: "table"}
 }
 
-func SetArgs() {
+// SetArgs parses the flags and the config file and returns the server they
+// configure
+func SetArgs() *rrdServer {
+	var config Config
+	var configFile string
+	flag.StringVar(&configFile, "config", "", "Path for a YAML configuration file. Flags given on the command line override it.")
 	flag.StringVar(&config.Server.IpAddr, "i", "", "Network interface IP address to listen on. (default: any)")
 	flag.IntVar(&config.Server.Port, "p", 9000, "Server port.")
 	flag.StringVar(&config.Server.RrdPath, "r", "./sample/", "Path for a directory that keeps RRD files.")
-	flag.IntVar(&config.Server.Step, "s", 10, "Step in second.")
+	flag.IntVar(&config.Server.Step, "s", 10, "Minimum step in second. Queries are fetched with a coarser step when their interval or maxDataPoints needs it.")
 	flag.Int64Var(&config.Server.SearchCache, "c", 600, "Search cache in seconds.")
 	flag.StringVar(&config.Server.AnnotationFilePath, "a", "", "Path for a file that has annotations.")
 	flag.IntVar(&config.Server.Multiplier, "m", 1, "Value multiplier.")
+	flag.IntVar(&config.Server.Workers, "w", 8, "Maximum number of RRD files fetched concurrently for a query.")
+	flag.IntVar(&config.Server.GlobDepth, "glob-depth", 16, "Maximum number of segments of a wildcard target. 0 means no limit.")
+	flag.IntVar(&config.Server.GlobMatches, "glob-matches", 10000, "Maximum number of RRD files a target may match. 0 means no limit.")
+	flag.BoolVar(&config.Server.Watch, "watch", false, "Update the search cache from filesystem events. -c still triggers a full rescan.")
+	flag.StringVar(&config.Server.WriteToken, "write-token", "", "Bearer token for the write endpoints, in addition to the writers of the config file.")
+	flag.StringVar(&config.Server.TLSCert, "tls-cert", "", "Path for a PEM certificate (chain). Serves HTTPS together with -tls-key.")
+	flag.StringVar(&config.Server.TLSKey, "tls-key", "", "Path for the PEM private key of -tls-cert.")
+	flag.StringVar(&config.Server.TLSClientCA, "tls-client-ca", "", "Path for a PEM CA bundle. Clients need a certificate signed by one of its CAs.")
 	flag.StringVar(&config.Server.RrdCached, "d", "", "RRDCached daemon address (e.g., unix:/var/run/rrdcached.sock or localhost:42217).")
 	flag.Parse()
+
+	if err := applyConfigFile(&config, configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	s, err := newRRDServer(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return s
+}
+
+// runAsPlugin is set by builds with the grafanaplugin tag. It serves the
+// Grafana plugin protocol and returns true when Grafana started the process.
+var runAsPlugin func() bool
+
+// registerHandlers adds the HTTP API to mux
+func (s *rrdServer) registerHandlers(mux *http.ServeMux) {
+	handle(mux, "/ls", s.withAuth(authRead, s.ls))
+	handle(mux, "/search", s.withAuth(authRead, s.search))
+	handle(mux, "/query", s.withAuth(authRead, s.query))
+	handle(mux, "/info", s.withAuth(authRead, s.info))
+	handle(mux, "/update", s.withAuth(authWrite, s.update))
+	handle(mux, "/create", s.withAuth(authWrite, s.create))
+	handle(mux, "/evaluate", s.withAuth(authRead, s.evaluate))
+	handle(mux, "/rules", s.withAuth(authRead, s.listRules))
+	handle(mux, "/annotations", s.withAuth(authRead, s.annotations))
+	handle(mux, "/annotations/events", s.withAuth(authWrite, s.annotationEvents))
+	handle(mux, "/annotations/events/", s.withAuth(authWrite, s.annotationEvents))
+	handle(mux, "/api/v1/query", s.withAuth(authRead, s.promQuery))
+	handle(mux, "/api/v1/query_range", s.withAuth(authRead, s.promQueryRange))
+	handle(mux, "/api/v1/series", s.withAuth(authRead, s.promSeriesHandler))
+	handle(mux, "/api/v1/labels", s.withAuth(authRead, s.promLabelsHandler))
+	handle(mux, "/api/v1/label/", s.withAuth(authRead, s.promLabelValuesHandler))
+	handle(mux, "/metrics", s.withAuth(authRead, metricsHandler))
+	// The health check stays open for load balancers
+	handle(mux, "/", hello)
+}
+
+// handle adds a handler to mux, measuring its requests under the pattern
+func handle(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, instrument(pattern, handler))
+}
+
+// startSearchCache fills the search cache and keeps it up to date in the
+// background until the returned function is called
+func (s *rrdServer) startSearchCache() (stop func()) {
+	var watcher *fsnotify.Watcher
+	if s.config.Server.Watch {
+		var err error
+		if watcher, err = watchRoots(s.searchCache); err != nil {
+			logger.Error("Cannot watch RRD directories, relying on periodic rescans", "error", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			s.searchCache.Update()
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Duration(s.config.Server.SearchCache) * time.Second):
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		if watcher != nil {
+			watcher.Close()
+		}
+	}
 }
 
 func main() {
-	SetArgs()
+	if runAsPlugin != nil && runAsPlugin() {
+		return
+	}
+
+	s := SetArgs()
 
 	// Initialize structured logger
 	logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
@@ -622,61 +1388,49 @@ func main() {
 	}))
 
 	logAttrs := []any{
-		"port", config.Server.Port,
-		"rrdPath", config.Server.RrdPath,
-		"step", config.Server.Step,
+		"port", s.config.Server.Port,
+		"step", s.config.Server.Step,
 	}
-
-	// Initialize rrdcached client if configured
-	if config.Server.RrdCached != "" {
-		var err error
-		// Determine if Unix socket or TCP
-		if strings.HasPrefix(config.Server.RrdCached, "unix:") {
-			socketPath := strings.TrimPrefix(config.Server.RrdCached, "unix:")
-			rrdcachedClient, err = rrdcached.NewClient(socketPath, rrdcached.Unix)
-		} else {
-			rrdcachedClient, err = rrdcached.NewClient(config.Server.RrdCached)
-		}
-		if err != nil {
-			logger.Error("Failed to connect to rrdcached, falling back to direct file access",
-				"daemon", config.Server.RrdCached, "error", err)
-			rrdcachedClient = nil
-		} else {
-			logAttrs = append(logAttrs, "rrdcached", config.Server.RrdCached)
-			logger.Info("Connected to rrdcached successfully", "daemon", config.Server.RrdCached)
-			defer rrdcachedClient.Close()
-		}
+	for _, root := range s.roots {
+		logAttrs = append(logAttrs, "root", root.name+"="+root.path)
 	}
 
+	s.roots.connect()
+	defer s.roots.close()
+
 	logger.Info("Starting Grafana RRD Server", logAttrs...)
 
-	http.HandleFunc("/ls", ls)
-	http.HandleFunc("/search", search)
-	http.HandleFunc("/query", query)
-	http.HandleFunc("/annotations", annotations)
-	http.HandleFunc("/", hello)
+	tlsConfig, err := newTLSConfig(s.config.Server)
+	if err != nil {
+		logger.Error("Cannot set up TLS", "error", err)
+		os.Exit(2)
+	}
 
-	// Start search cache updater
-	go func() {
-		for {
-			searchCache.Update()
-			time.Sleep(time.Duration(config.Server.SearchCache) * time.Second)
-		}
-	}()
+	s.registerHandlers(http.DefaultServeMux)
+	s.startSearchCache()
+	s.startRules()
 
 	// Create HTTP server with timeouts
 	// Longer timeouts to accommodate slow rrdcached responses
 	server := &http.Server{
-		Addr:         config.Server.IpAddr + ":" + strconv.Itoa(config.Server.Port),
+		Addr:         s.config.Server.IpAddr + ":" + strconv.Itoa(s.config.Server.Port),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
+		TLSConfig:    tlsConfig,
 	}
 
 	// Start server in a goroutine
 	go func() {
-		logger.Info("Server listening", "address", server.Addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Info("Server listening", "address", server.Addr, "tls", tlsConfig != nil, "clientCA", s.config.Server.TLSClientCA)
+		var err error
+		if tlsConfig != nil {
+			// The certificate comes from TLSConfig, which reloads it
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Error("Server error", "error", err)
 			os.Exit(1)
 		}
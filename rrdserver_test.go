@@ -9,6 +9,34 @@ import (
 	"testing"
 )
 
+// sampleConfig returns the flag defaults, which serve the sample directory
+func sampleConfig() Config {
+	return Config{Server: ServerConfig{
+		RrdPath:     "./sample/",
+		Step:        10,
+		SearchCache: 600,
+		Multiplier:  1,
+		Workers:     8,
+		GlobDepth:   16,
+		GlobMatches: 10000,
+	}}
+}
+
+// newTestServer returns a server of config with a filled search cache
+func newTestServer(t *testing.T, config Config) *rrdServer {
+	s, err := newRRDServer(config)
+	if err != nil {
+		t.Fatalf("Cannot set up the server. %v", err)
+	}
+	s.searchCache.Update()
+	return s
+}
+
+// sampleServer returns a server of the sample directory
+func sampleServer(t *testing.T) *rrdServer {
+	return newTestServer(t, sampleConfig())
+}
+
 func TestHello(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(hello))
 	defer ts.Close()
@@ -33,13 +61,13 @@ func TestHello(t *testing.T) {
 }
 
 func TestSearch(t *testing.T) {
-	SetArgs()
-	searchCache.Update()
+	s := SetArgs()
+	s.searchCache.Update()
 
 	requestJSON := `{"target":"sample"}`
 	reader := strings.NewReader(requestJSON)
 
-	ts := httptest.NewServer(http.HandlerFunc(search))
+	ts := httptest.NewServer(http.HandlerFunc(s.search))
 	defer ts.Close()
 
 	r, err := http.Post(ts.URL, "application/json", reader)
@@ -62,7 +90,7 @@ func TestSearch(t *testing.T) {
 }
 
 func TestQuery(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(query))
+	ts := httptest.NewServer(http.HandlerFunc(sampleServer(t).query))
 	defer ts.Close()
 	client := &http.Client{}
 
@@ -171,10 +199,283 @@ func TestQuery(t *testing.T) {
 	}
 }
 
+func TestQueryConsolidationFunction(t *testing.T) {
+	s := sampleServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(s.query))
+	defer ts.Close()
+
+	requestJSON := `{
+	  "range":{
+	    "from":"2016-12-07T22:47:00Z",
+	    "to":"2016-12-08T02:08:00Z"
+	  },
+	  "targets":[
+	    {"target":"percent:percent-idle:value@MAX","refId":"A"},
+	    {"target":"percent:percent-idle:value","refId":"B","cf":"min"},
+	    {"target":"sample:ClientJobsIdle@MAX","refId":"C"}
+	  ]
+	}`
+
+	r, err := http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	if r.StatusCode != 200 {
+		t.Fatalf("Status code is not 200 but %d.", r.StatusCode)
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var qrs = []QueryResponse{}
+	err = decoder.Decode(&qrs)
+	if err != nil {
+		t.Fatalf("Error at decoding JSON response. %v", err)
+	}
+
+	targets := map[string]bool{}
+	for _, v := range qrs {
+		targets[v.Target] = true
+	}
+	if !targets["percent:percent-idle:value@MAX"] {
+		t.Fatalf("percent:percent-idle:value@MAX isn't contained in the response. %v", targets)
+	}
+	if !targets["percent:percent-idle:value@MIN"] {
+		t.Fatalf("percent:percent-idle:value@MIN isn't contained in the response. %v", targets)
+	}
+	if targets["sample:ClientJobsIdle@MAX"] {
+		t.Fatal("sample.rrd has no MAX archive but a series is returned for it.")
+	}
+
+	// Test for an unknown consolidation function
+	requestJSON = `{"targets":[{"target":"sample:ClientJobsIdle@MEDIAN","refId":"A"}]}`
+	r, err = http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	if r.StatusCode != 400 {
+		t.Fatalf("Status code is not 400 but %d.", r.StatusCode)
+	}
+
+	// Search offers the non-default CFs as targets
+	sts := httptest.NewServer(http.HandlerFunc(s.search))
+	defer sts.Close()
+
+	r, err = http.Post(sts.URL, "application/json", strings.NewReader(`{"target":"percent-idle:value@"}`))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	var searchResponse []string
+	json.NewDecoder(r.Body).Decode(&searchResponse)
+
+	maxExists := false
+	for _, v := range searchResponse {
+		if v == "percent:percent-idle:value@MAX" {
+			maxExists = true
+		}
+		if v == "percent:percent-idle:value@AVERAGE" {
+			t.Fatal("The default CF shouldn't be offered as a separate target.")
+		}
+	}
+	if !maxExists {
+		t.Fatalf("percent:percent-idle:value@MAX isn't contained in the search response. %v", searchResponse)
+	}
+}
+
+func TestQueryMaxDataPoints(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(sampleServer(t).query))
+	defer ts.Close()
+
+	requestJSON := `{
+	  "range":{
+	    "from":"2016-12-07T22:47:00Z",
+	    "to":"2016-12-08T02:08:00Z"
+	  },
+	  "intervalMs":10000,
+	  "targets":[
+	    {"target":"percent:percent-idle:value","refId":"A"}
+	  ],
+	  "maxDataPoints":100
+	}`
+
+	r, err := http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	if r.StatusCode != 200 {
+		t.Fatalf("Status code is not 200 but %d.", r.StatusCode)
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var qrs = []QueryResponse{}
+	err = decoder.Decode(&qrs)
+	if err != nil {
+		t.Fatalf("Error at decoding JSON response. %v", err)
+	}
+
+	if len(qrs) != 1 {
+		t.Fatalf("Expected one series but got %d.", len(qrs))
+	}
+	if len(qrs[0].DataPoints) == 0 || len(qrs[0].DataPoints) > 100 {
+		t.Fatalf("Expected 1 to 100 datapoints but got %d.", len(qrs[0].DataPoints))
+	}
+}
+
+func TestQueryEmptyTarget(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(sampleServer(t).query))
+	defer ts.Close()
+
+	// Grafana sends new query rows before a target is chosen
+	requestJSON := `{
+	  "range":{
+	    "from":"2016-12-07T22:47:00Z",
+	    "to":"2016-12-08T02:08:00Z"
+	  },
+	  "targets":[
+	    {"target":"","refId":"A"},
+	    {"target":" ","refId":"B"},
+	    {"target":"percent:percent-idle:value","refId":"C"}
+	  ]
+	}`
+
+	r, err := http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	if r.StatusCode != 200 {
+		t.Fatalf("Status code is not 200 but %d.", r.StatusCode)
+	}
+
+	var qrs = []QueryResponse{}
+	if err := json.NewDecoder(r.Body).Decode(&qrs); err != nil {
+		t.Fatalf("Error at decoding JSON response. %v", err)
+	}
+	if len(qrs) != 1 || qrs[0].Target != "percent:percent-idle:value" {
+		t.Fatalf("Empty targets shouldn't have series. %+v", qrs)
+	}
+
+	// Invalid targets are still rejected
+	r, err = http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(`{"targets":[{"target":"percent:..:value","refId":"A"}]}`))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+	if r.StatusCode != 400 {
+		t.Fatalf("Status code is not 400 but %d.", r.StatusCode)
+	}
+}
+
+func TestQueryConcurrentOrder(t *testing.T) {
+	s := sampleServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(s.query))
+	defer ts.Close()
+
+	requestJSON := `{
+	  "range":{
+	    "from":"2025-11-10T16:00:00Z",
+	    "to":"2025-11-11T16:00:00Z"
+	  },
+	  "targets":[
+	    {"target":"librenms:host:poller-perf-*:poller","refId":"A"},
+	    {"target":"sample:ClientJobsIdle","refId":"B"},
+	    {"target":"librenms:host:mempool-*:used","refId":"C"}
+	  ]
+	}`
+
+	queryTargets := func(workers int) []string {
+		s.config.Server.Workers = workers
+
+		r, err := http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+		if err != nil {
+			t.Fatalf("Error at an POST request. %v", err)
+		}
+
+		var qrs = []QueryResponse{}
+		err = json.NewDecoder(r.Body).Decode(&qrs)
+		if err != nil {
+			t.Fatalf("Error at decoding JSON response. %v", err)
+		}
+
+		targets := []string{}
+		for _, v := range qrs {
+			targets = append(targets, v.Target)
+		}
+		return targets
+	}
+
+	sequential := queryTargets(1)
+	concurrent := queryTargets(8)
+
+	if len(sequential) < 3 {
+		t.Fatalf("Too few series in the response. %v", sequential)
+	}
+	if strings.Join(sequential, ",") != strings.Join(concurrent, ",") {
+		t.Fatalf("Concurrent fetch changed the order of series.\n%v\n%v", sequential, concurrent)
+	}
+}
+
+func TestQueryTable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(sampleServer(t).query))
+	defer ts.Close()
+
+	requestJSON := `{
+	  "range":{
+	    "from":"2016-12-07T22:47:00Z",
+	    "to":"2016-12-08T02:08:00Z"
+	  },
+	  "targets":[
+	    {"target":"percent:percent-*:value","refId":"A","type":"table"},
+	    {"target":"percent:percent-idle:value","refId":"B","type":"timeserie"}
+	  ]
+	}`
+
+	r, err := http.Post(ts.URL, "application/json; charset=utf-8", strings.NewReader(requestJSON))
+	if err != nil {
+		t.Fatalf("Error at an POST request. %v", err)
+	}
+
+	var response []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		t.Fatalf("Error at decoding JSON response. %v", err)
+	}
+	if len(response) != 2 {
+		t.Fatalf("Expected a table and a series. %s", response)
+	}
+
+	var table TableResponse
+	if err := json.Unmarshal(response[0], &table); err != nil {
+		t.Fatalf("Error at decoding the table. %v", err)
+	}
+	if table.Type != "table" || len(table.Columns) != 6 {
+		t.Fatalf("Unexpected table. %+v", table)
+	}
+	if len(table.Rows) != 2 || table.Rows[0][0] != "percent:percent-idle:value" {
+		t.Fatalf("Expected a row per file. %v", table.Rows)
+	}
+	for _, row := range table.Rows {
+		min, max, avg := row[3].(float64), row[4].(float64), row[5].(float64)
+		if min > avg || avg > max {
+			t.Fatalf("Avg should be between min and max. %v", row)
+		}
+	}
+
+	var series QueryResponse
+	if err := json.Unmarshal(response[1], &series); err != nil || len(series.DataPoints) == 0 {
+		t.Fatalf("Expected a timeseries. %s", response[1])
+	}
+	last := series.DataPoints[len(series.DataPoints)-1]
+	if table.Rows[0][1].(float64) != last[1] || table.Rows[0][2].(float64) != last[0] {
+		t.Fatalf("Last should be the last point of the series. %v %v", table.Rows[0], last)
+	}
+}
+
 func TestAnnotations(t *testing.T) {
+	config := sampleConfig()
 	config.Server.AnnotationFilePath = "./sample/annotations.csv"
 
-	ts := httptest.NewServer(http.HandlerFunc(annotations))
+	ts := httptest.NewServer(http.HandlerFunc(newTestServer(t, config).annotations))
 	defer ts.Close()
 
 	requestJSON := `{
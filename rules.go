@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statePending is the state of a series whose conditions hold but not yet
+// for the "for" duration of its rule
+const statePending = "pending"
+
+// defaultRuleInterval is used when the alerting settings have no interval
+const defaultRuleInterval = "1m"
+
+// RuleAlert is a state change of a series as posted to the webhook. Since is
+// when the series entered the state; for alerting, when it became pending.
+type RuleAlert struct {
+	Target        string   `json:"target"`
+	State         string   `json:"state"`
+	PreviousState string   `json:"previousState"`
+	Value         *float64 `json:"value"`
+	Since         string   `json:"since"`
+}
+
+// RuleNotification is the body of a webhook request. It has the state
+// changes found by one evaluation of a rule.
+type RuleNotification struct {
+	Rule   string      `json:"rule"`
+	Time   string      `json:"time"`
+	Alerts []RuleAlert `json:"alerts"`
+}
+
+// RuleStatus is the state of a rule as returned by /rules
+type RuleStatus struct {
+	Name           string             `json:"name"`
+	Target         string             `json:"target"`
+	LastEvaluation string             `json:"lastEvaluation,omitempty"`
+	Error          string             `json:"error,omitempty"`
+	Series         []RuleSeriesStatus `json:"series"`
+}
+
+type RuleSeriesStatus struct {
+	Target string   `json:"target"`
+	State  string   `json:"state"`
+	Value  *float64 `json:"value"`
+	Since  string   `json:"since"`
+}
+
+// ruleSeries tracks a series of a rule. notified is the last state sent to
+// the webhook, so pending series that recover don't notify at all.
+type ruleSeries struct {
+	state    string
+	value    *float64
+	since    time.Time
+	notified string
+}
+
+type ruleState struct {
+	rule        RuleConfig
+	forDuration time.Duration
+
+	m         sync.Mutex
+	series    map[string]*ruleSeries
+	lastEval  time.Time
+	lastError string
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// setupRules creates the state of the configured rules, which have been
+// checked when the config file was loaded
+func (s *rrdServer) setupRules() {
+	s.rules = make([]*ruleState, 0, len(s.config.Alerting.Rules))
+	for _, rule := range s.config.Alerting.Rules {
+		forDuration, _ := parseOptionalDuration(rule.For, "0")
+		s.rules = append(s.rules, &ruleState{
+			rule:        rule,
+			forDuration: forDuration,
+			series:      map[string]*ruleSeries{},
+		})
+	}
+}
+
+func (s *rrdServer) startRules() {
+	if len(s.rules) == 0 {
+		return
+	}
+	interval, _ := parseOptionalDuration(s.config.Alerting.Interval, defaultRuleInterval)
+	logger.Info("Evaluating alert rules", "rules", len(s.rules), "interval", interval.String())
+
+	go func() {
+		for {
+			s.evaluateRules(time.Now())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// evaluateRules evaluates every rule and notifies the state changes
+func (s *rrdServer) evaluateRules(now time.Time) {
+	for _, rs := range s.rules {
+		if alerts := rs.evaluate(s, now); len(alerts) > 0 {
+			s.notifyRule(rs.rule, now, alerts)
+		}
+	}
+}
+
+// evaluate updates the state of the series of a rule and returns the changes
+// to notify. A series that disappears from the result is notified as nodata
+// and forgotten, so series of removed files don't pile up.
+func (rs *ruleState) evaluate(server *rrdServer, now time.Time) []RuleAlert {
+	result, err := server.evaluateRequestAt(EvaluateRequest{
+		Target:     rs.rule.Target,
+		CF:         rs.rule.CF,
+		Window:     rs.rule.Window,
+		Reducer:    rs.rule.Reducer,
+		Conditions: rs.rule.Conditions,
+	}, now, nil)
+
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	rs.lastEval = now
+	if err != nil {
+		logger.Error("Cannot evaluate rule", "rule", rs.rule.Name, "error", err)
+		rs.lastError = err.Error()
+		return nil
+	}
+	rs.lastError = ""
+
+	var alerts []RuleAlert
+	seen := map[string]bool{}
+	transition := func(target, evaluated string, value *float64) {
+		seen[target] = true
+		s, ok := rs.series[target]
+		if !ok {
+			s = &ruleSeries{state: stateOK, since: now, notified: stateOK}
+			rs.series[target] = s
+		}
+
+		next := evaluated
+		if evaluated == stateAlerting {
+			start := now
+			if s.state == statePending || s.state == stateAlerting {
+				start = s.since
+			}
+			if now.Sub(start) < rs.forDuration {
+				next = statePending
+			}
+		}
+		if next != s.state && !(s.state == statePending && next == stateAlerting) {
+			s.since = now
+		}
+		s.state, s.value = next, value
+
+		if next != statePending && next != s.notified {
+			alerts = append(alerts, RuleAlert{
+				Target:        target,
+				State:         next,
+				PreviousState: s.notified,
+				Value:         value,
+				Since:         s.since.UTC().Format(time.RFC3339),
+			})
+			s.notified = next
+		}
+	}
+
+	for _, series := range result.Series {
+		transition(series.Target, series.State, series.Value)
+	}
+	for target := range rs.series {
+		if !seen[target] {
+			transition(target, stateNoData, nil)
+			delete(rs.series, target)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Target < alerts[j].Target })
+	return alerts
+}
+
+// notifyRule logs state changes and posts them to the webhook of the rule.
+// A failed request is logged and not retried; the next change is sent anyway.
+func (s *rrdServer) notifyRule(rule RuleConfig, now time.Time, alerts []RuleAlert) {
+	for _, alert := range alerts {
+		logger.Info("Alert state changed", "rule", rule.Name, "target", alert.Target,
+			"state", alert.State, "previousState", alert.PreviousState)
+	}
+
+	webhook := rule.Webhook
+	if webhook == "" {
+		webhook = s.config.Alerting.Webhook
+	}
+	if webhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(RuleNotification{
+		Rule:   rule.Name,
+		Time:   now.UTC().Format(time.RFC3339),
+		Alerts: alerts,
+	})
+	if err != nil {
+		logger.Error("Cannot encode notification", "rule", rule.Name, "error", err)
+		return
+	}
+	resp, err := webhookClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error("Cannot send notification", "rule", rule.Name, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Error("Webhook rejected notification", "rule", rule.Name, "status", resp.StatusCode)
+	}
+}
+
+// listRules serves the state of the alert rules. With access rules, users
+// only see the series of files they may read and the rules having any.
+func (s *rrdServer) listRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "accept, content-type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,OPTIONS")
+		w.Write(nil)
+		return
+	}
+
+	access := s.accessFor(r)
+	result := make([]RuleStatus, 0, len(s.rules))
+	for _, rs := range s.rules {
+		status := rs.status()
+		if access != nil {
+			status.Series = slices.DeleteFunc(status.Series, func(series RuleSeriesStatus) bool {
+				return !s.seriesAllowed(access, series.Target)
+			})
+			if len(status.Series) == 0 {
+				continue
+			}
+		}
+		result = append(result, status)
+	}
+	respondJSON(w, result)
+}
+
+// seriesAllowed reports whether a series of a rule is of a file the user may
+// read. Series computed by expressions can combine several files, so they
+// aren't named after one and are only shown without access rules.
+func (s *rrdServer) seriesAllowed(access pathAccess, target string) bool {
+	target, _ = splitTargetCF(target)
+	i := strings.LastIndex(target, ":")
+	return i > 0 && s.searchCache.HasFile(target[:i]) && access(target[:i])
+}
+
+func (rs *ruleState) status() RuleStatus {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	status := RuleStatus{
+		Name:   rs.rule.Name,
+		Target: rs.rule.Target,
+		Error:  rs.lastError,
+		Series: make([]RuleSeriesStatus, 0, len(rs.series)),
+	}
+	if !rs.lastEval.IsZero() {
+		status.LastEvaluation = rs.lastEval.UTC().Format(time.RFC3339)
+	}
+	for target, s := range rs.series {
+		status.Series = append(status.Series, RuleSeriesStatus{
+			Target: target,
+			State:  s.state,
+			Value:  s.value,
+			Since:  s.since.UTC().Format(time.RFC3339),
+		})
+	}
+	sort.Slice(status.Series, func(i, j int) bool { return status.Series[i].Target < status.Series[j].Target })
+	return status
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRuleStates(t *testing.T) {
+	s := sampleServer(t)
+
+	rs := &ruleState{
+		rule: RuleConfig{
+			Name:       "idle",
+			Target:     "percent:percent-idle:value",
+			Window:     "30m",
+			Reducer:    "max",
+			Conditions: []EvaluateCondition{{Op: ">", Value: -1}},
+		},
+		forDuration: 2 * time.Minute,
+		series:      map[string]*ruleSeries{},
+	}
+
+	start := time.Date(2016, 12, 8, 2, 0, 0, 0, time.UTC)
+	for _, minutes := range []int{0, 1} {
+		if alerts := rs.evaluate(s, start.Add(time.Duration(minutes)*time.Minute)); len(alerts) != 0 {
+			t.Fatalf("Pending series shouldn't be notified. %+v", alerts)
+		}
+	}
+	if status := rs.status(); len(status.Series) != 1 || status.Series[0].State != statePending {
+		t.Fatalf("The series should be pending. %+v", status)
+	}
+
+	alerts := rs.evaluate(s, start.Add(2*time.Minute))
+	if len(alerts) != 1 || alerts[0].State != stateAlerting || alerts[0].PreviousState != stateOK ||
+		alerts[0].Since != "2016-12-08T02:00:00Z" || alerts[0].Value == nil {
+		t.Fatalf("The series should be alerting since it became pending. %+v", alerts)
+	}
+	if alerts := rs.evaluate(s, start.Add(3*time.Minute)); len(alerts) != 0 {
+		t.Fatalf("An unchanged state shouldn't be notified again. %+v", alerts)
+	}
+
+	// The sample files have no data years later
+	alerts = rs.evaluate(s, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	if len(alerts) != 1 || alerts[0].State != stateNoData || alerts[0].PreviousState != stateAlerting {
+		t.Fatalf("The series should be nodata. %+v", alerts)
+	}
+
+	// Series missing from the result are dropped
+	rs.rule.Target = "percent:percent-user:value"
+	rs.evaluate(s, start)
+	if status := rs.status(); len(status.Series) != 1 || status.Series[0].Target != "percent:percent-user:value" {
+		t.Fatalf("Only the evaluated series should be kept. %+v", status)
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	notifications := make(chan RuleNotification, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n RuleNotification
+		json.NewDecoder(r.Body).Decode(&n)
+		notifications <- n
+	}))
+	defer webhook.Close()
+
+	config := sampleConfig()
+	config.Alerting = AlertingConfig{
+		Webhook: webhook.URL,
+		Rules: []RuleConfig{{
+			Name:       "busy",
+			Target:     "percent:percent-*:value",
+			Window:     "30m",
+			Reducer:    "min",
+			Conditions: []EvaluateCondition{{Op: "<", Value: 1000}},
+		}},
+	}
+	s := newTestServer(t, config)
+
+	now := time.Date(2016, 12, 8, 2, 0, 0, 0, time.UTC)
+	s.evaluateRules(now)
+	select {
+	case n := <-notifications:
+		if n.Rule != "busy" || n.Time != "2016-12-08T02:00:00Z" || len(n.Alerts) != 2 ||
+			n.Alerts[0].Target != "percent:percent-idle:value" || n.Alerts[0].State != stateAlerting {
+			t.Fatalf("Unexpected notification. %+v", n)
+		}
+	default:
+		t.Fatalf("No notification was sent.")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.listRules))
+	defer ts.Close()
+	r, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Error at a GET request. %v", err)
+	}
+	var res []RuleStatus
+	json.NewDecoder(r.Body).Decode(&res)
+	if len(res) != 1 || res[0].LastEvaluation != "2016-12-08T02:00:00Z" || len(res[0].Series) != 2 ||
+		res[0].Series[1].State != stateAlerting {
+		t.Fatalf("Unexpected rule status. %+v", res)
+	}
+
+	// Users with access rules only see the series of their files
+	s.config.Auth = AuthConfig{
+		Tokens: []TokenConfig{{Name: "alice", Token: "alice-token"}, {Name: "bob", Token: "bob-token"}},
+		Read:   []string{"*"},
+		Access: []AccessConfig{
+			{Users: []string{"alice"}, Paths: []string{"percent:percent-idle"}},
+			{Users: []string{"bob"}, Paths: []string{"librenms"}},
+		},
+	}
+	authorized := httptest.NewServer(s.withAuth(authRead, s.listRules))
+	defer authorized.Close()
+	get := func(token string) []RuleStatus {
+		req, _ := http.NewRequest("GET", authorized.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error at a GET request. %v", err)
+		}
+		var res []RuleStatus
+		json.NewDecoder(r.Body).Decode(&res)
+		return res
+	}
+	if res := get("alice-token"); len(res) != 1 || len(res[0].Series) != 1 || res[0].Series[0].Target != "percent:percent-idle:value" {
+		t.Fatalf("Alice should only see percent-idle. %+v", res)
+	}
+	if res := get("bob-token"); len(res) != 0 {
+		t.Fatalf("Bob shouldn't see the rule. %+v", res)
+	}
+}
+
+func TestCheckAlerting(t *testing.T) {
+	valid := RuleConfig{Name: "r", Target: "a:b", Conditions: []EvaluateCondition{{Op: ">", Value: 1}}}
+	if err := checkAlerting(AlertingConfig{Rules: []RuleConfig{valid}}); err != nil {
+		t.Fatalf("A valid rule was rejected. %v", err)
+	}
+
+	invalid := map[string]AlertingConfig{
+		"interval":  {Interval: "0s"},
+		"webhook":   {Webhook: "ftp://example.com/"},
+		"duplicate": {Rules: []RuleConfig{valid, valid}},
+	}
+	for name, modify := range map[string]func(*RuleConfig){
+		"name":      func(r *RuleConfig) { r.Name = "" },
+		"target":    func(r *RuleConfig) { r.Target = "" },
+		"reducer":   func(r *RuleConfig) { r.Reducer = "median" },
+		"operator":  func(r *RuleConfig) { r.Conditions = []EvaluateCondition{{Op: "=<"}} },
+		"condition": func(r *RuleConfig) { r.Conditions = nil },
+		"for":       func(r *RuleConfig) { r.For = "soon" },
+	} {
+		rule := valid
+		modify(&rule)
+		invalid[name] = AlertingConfig{Rules: []RuleConfig{rule}}
+	}
+	for name, a := range invalid {
+		if err := checkAlerting(a); err == nil {
+			t.Fatalf("An invalid %s should be rejected.", name)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsFiles serves the certificate, key and client CA bundle of the TLS
+// listener. The files are checked at every handshake and read again when one
+// changes, so renewed certificates are used without a restart. If they can't
+// be read, for example while a renewal has written the certificate but not
+// the key yet, the previous ones are kept.
+type tlsFiles struct {
+	certFile, keyFile, caFile string
+
+	m        sync.Mutex
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+// newTLSConfig returns the TLS settings of the listener, or nil when no
+// certificate is configured. A client CA bundle makes the server require
+// client certificates signed by one of its CAs.
+func newTLSConfig(server ServerConfig) (*tls.Config, error) {
+	if server.TLSCert == "" && server.TLSKey == "" {
+		if server.TLSClientCA != "" {
+			return nil, errors.New("a client CA bundle needs a TLS certificate and key")
+		}
+		return nil, nil
+	}
+	if server.TLSCert == "" || server.TLSKey == "" {
+		return nil, errors.New("TLS needs both a certificate and a key")
+	}
+
+	files := &tlsFiles{certFile: server.TLSCert, keyFile: server.TLSKey, caFile: server.TLSClientCA}
+	if err := files.load(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: files.certificate,
+	}
+	if files.caFile != "" {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := tlsConfig.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = files.clientCAs()
+			return c, nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// load reads the files again if one of them has changed since the last time
+func (f *tlsFiles) load() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	var modTimes [3]time.Time
+	for i, name := range []string{f.certFile, f.keyFile, f.caFile} {
+		if name == "" {
+			continue
+		}
+		stat, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = stat.ModTime()
+	}
+	if f.cert != nil && modTimes == f.modTimes {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCA *x509.CertPool
+	if f.caFile != "" {
+		pem, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return err
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", f.caFile)
+		}
+	}
+
+	if f.cert != nil {
+		logger.Info("Reloaded TLS certificate", "cert", f.certFile, "clientCA", f.caFile)
+	}
+	f.modTimes, f.cert, f.clientCA = modTimes, &cert, clientCA
+	return nil
+}
+
+// reload loads changed files, keeping the previous ones on errors
+func (f *tlsFiles) reload() {
+	if err := f.load(); err != nil {
+		logger.Error("Cannot reload TLS certificate, keeping the previous one", "cert", f.certFile, "error", err)
+	}
+}
+
+func (f *tlsFiles) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.reload()
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.cert, nil
+}
+
+func (f *tlsFiles) clientCAs() *x509.CertPool {
+	f.reload()
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.clientCA
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate signed by parent, or a self-signed CA without one
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key. %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Cannot create certificate. %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) write(t *testing.T, certPath, keyPath string, modTime time.Time) {
+	writeFile(t, certPath, string(c.certPEM))
+	writeFile(t, keyPath, string(c.keyPEM))
+	os.Chtimes(certPath, modTime, modTime)
+	os.Chtimes(keyPath, modTime, modTime)
+}
+
+// serveTLS serves hello with a TLS config and returns the URL. httptest's
+// TLS servers add a certificate of their own, which would take precedence.
+func serveTLS(t *testing.T, tlsConfig *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Cannot listen. %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(hello), ErrorLog: log.New(io.Discard, "", 0)}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	ca := newTestCert(t, "ca", nil)
+	newTestCert(t, "first", ca).write(t, certPath, keyPath, time.Now().Add(-time.Minute))
+
+	tlsConfig, err := newTLSConfig(ServerConfig{TLSCert: certPath, TLSKey: keyPath})
+	if err != nil {
+		t.Fatalf("Cannot set up TLS. %v", err)
+	}
+	url := serveTLS(t, tlsConfig)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	servedName := func() string {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		r, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Error at a GET request. %v", err)
+		}
+		r.Body.Close()
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if name := servedName(); name != "first" {
+		t.Fatalf("Expected the first certificate but %s.", name)
+	}
+
+	// A half-written renewal keeps the previous certificate
+	writeFile(t, keyPath, "")
+	if name := servedName(); name != "first" {
+		t.Fatalf("A broken key should keep the previous certificate but %s.", name)
+	}
+	newTestCert(t, "second", ca).write(t, certPath, keyPath, time.Now())
+	if name := servedName(); name != "second" {
+		t.Fatalf("Expected the renewed certificate but %s.", name)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, caPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")
+	ca := newTestCert(t, "ca", nil)
+	newTestCert(t, "server", ca).write(t, certPath, keyPath, time.Now())
+	writeFile(t, caPath, string(ca.certPEM))
+
+	tlsConfig, err := newTLSConfig(ServerConfig{TLSCert: certPath, TLSKey: keyPath, TLSClientCA: caPath})
+	if err != nil {
+		t.Fatalf("Cannot set up TLS. %v", err)
+	}
+	url := serveTLS(t, tlsConfig)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(client *testCert) error {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if client != nil {
+			pair, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+			if err != nil {
+				t.Fatalf("Cannot load client certificate. %v", err)
+			}
+			clientConfig.Certificates = []tls.Certificate{pair}
+		}
+		r, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}).Get(url)
+		if err == nil {
+			r.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(newTestCert(t, "grafana", ca)); err != nil {
+		t.Fatalf("Clients with a certificate of the CA should be accepted. %v", err)
+	}
+	if err := get(nil); err == nil {
+		t.Fatalf("Clients without a certificate should be rejected.")
+	}
+	if err := get(newTestCert(t, "other", newTestCert(t, "other-ca", nil))); err == nil {
+		t.Fatalf("Clients with a certificate of another CA should be rejected.")
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	if c, err := newTLSConfig(ServerConfig{}); c != nil || err != nil {
+		t.Fatalf("TLS should be off without a certificate. %v %v", c, err)
+	}
+	dir := t.TempDir()
+	for _, server := range []ServerConfig{
+		{TLSCert: filepath.Join(dir, "server.crt")},
+		{TLSClientCA: filepath.Join(dir, "ca.crt")},
+		{TLSCert: filepath.Join(dir, "server.crt"), TLSKey: filepath.Join(dir, "server.key")},
+	} {
+		if _, err := newTLSConfig(server); err == nil {
+			t.Fatalf("%+v should be rejected.", server)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	rrdcached "github.com/multiplay/go-rrd"
+	"github.com/ziutek/rrd"
+)
+
+// UpdateRequest holds samples for a "path:to:file:ds" target in the
+// [value, timestamp_ms] form of query responses. A null value is written as
+// unknown.
+type UpdateRequest struct {
+	Target     string       `json:"target"`
+	DataPoints [][]*float64 `json:"datapoints"`
+}
+
+type UpdateResponse struct {
+	Updated int `json:"updated"`
+}
+
+// fileUpdate collects the samples for one RRD file. Samples of several DSes
+// with the same timestamp are written as one update, so rows holds a value
+// per DS for each timestamp in seconds.
+type fileUpdate struct {
+	root     *rrdRoot
+	filePath string
+	dsIndex  map[string]int
+	rows     map[int64][]string
+}
+
+// update writes samples with rrdupdate semantics: DSes without a sample at a
+// timestamp are unknown, and timestamps must be newer than the last update.
+// The body is an UpdateRequest or an array of them.
+func (s *rrdServer) update(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "accept, authorization, content-type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST,OPTIONS")
+		w.Write(nil)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		respondJSONStatus(w, http.StatusMethodNotAllowed, ErrorResponse{Message: "Method not allowed"})
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		logger.Error("Cannot decode update request", "error", err)
+		respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: "Cannot decode the request"})
+		return
+	}
+	defer r.Body.Close()
+
+	var requests []UpdateRequest
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err := json.Unmarshal(body, &requests)
+		if err != nil {
+			respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: "Cannot decode the request"})
+			return
+		}
+	} else {
+		var single UpdateRequest
+		if err := json.Unmarshal(body, &single); err != nil {
+			respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: "Cannot decode the request"})
+			return
+		}
+		requests = []UpdateRequest{single}
+	}
+
+	updates, count, status, err := s.collectUpdates(requests, s.accessFor(r))
+	if err != nil {
+		respondJSONStatus(w, status, ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	// Files are written in request order. A failure leaves the files before
+	// it updated.
+	for _, u := range updates {
+		timestamps := make([]int64, 0, len(u.rows))
+		for ts := range u.rows {
+			timestamps = append(timestamps, ts)
+		}
+		sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+		lines := make([]string, len(timestamps))
+		for i, ts := range timestamps {
+			lines[i] = strconv.FormatInt(ts, 10) + ":" + strings.Join(u.rows[ts], ":")
+		}
+		if err := u.root.updateRRD(u.filePath, lines); err != nil {
+			target := u.root.target(u.filePath)
+			logger.Error("Cannot update RRD file", "path", u.filePath, "error", err)
+			respondJSONStatus(w, http.StatusBadRequest, ErrorResponse{Message: fmt.Sprintf("Cannot update %s: %v", target, err)})
+			return
+		}
+	}
+
+	logger.Info("Updated RRD files", "files", len(updates), "samples", count)
+	respondJSON(w, UpdateResponse{Updated: count})
+}
+
+// collectUpdates groups the samples by file. It returns the HTTP status for
+// an error, which names the offending target. Files the user can't read are
+// reported missing like in /info.
+func (s *rrdServer) collectUpdates(requests []UpdateRequest, access pathAccess) ([]*fileUpdate, int, int, error) {
+	var updates []*fileUpdate
+	byFile := map[string]*fileUpdate{}
+	count := 0
+	for _, req := range requests {
+		if strings.Contains(req.Target, "@") {
+			return nil, 0, http.StatusBadRequest, fmt.Errorf("cannot update consolidated target %s", req.Target)
+		}
+		i := strings.LastIndex(req.Target, ":")
+		if i <= 0 {
+			return nil, 0, http.StatusBadRequest, fmt.Errorf("target %q has no data source", req.Target)
+		}
+		fileTarget, ds := req.Target[:i], req.Target[i+1:]
+
+		root, filePath := s.roots.fileForTarget(fileTarget)
+		if root == nil || !root.contains(filePath) || !s.roots.owns(root, filePath) || !access.allows(root.target(filePath)) {
+			return nil, 0, http.StatusNotFound, fmt.Errorf("no RRD file for target %s", req.Target)
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			return nil, 0, http.StatusNotFound, fmt.Errorf("no RRD file for target %s", req.Target)
+		}
+
+		u, ok := byFile[filePath]
+		if !ok {
+			header, err := root.cachedInfo(filePath)
+			if err != nil {
+				logger.Error("Cannot retrieve information from RRD file", "path", filePath, "error", err)
+				return nil, 0, http.StatusInternalServerError, fmt.Errorf("cannot read the RRD file of %s", req.Target)
+			}
+			u = &fileUpdate{root: root, filePath: filePath, dsIndex: header.DsIndex, rows: map[int64][]string{}}
+			byFile[filePath] = u
+			updates = append(updates, u)
+		}
+		dsIndex, ok := u.dsIndex[ds]
+		if !ok {
+			return nil, 0, http.StatusNotFound, fmt.Errorf("data source %s doesn't exist in %s", ds, fileTarget)
+		}
+
+		for _, p := range req.DataPoints {
+			if len(p) != 2 || p[1] == nil {
+				return nil, 0, http.StatusBadRequest, fmt.Errorf("data points of %s must be [value, timestamp_ms]", req.Target)
+			}
+			ts := int64(*p[1]) / 1000
+			row, ok := u.rows[ts]
+			if !ok {
+				row = make([]string, len(u.dsIndex))
+				for j := range row {
+					row[j] = "U"
+				}
+				u.rows[ts] = row
+			}
+			if p[0] != nil {
+				row[dsIndex] = strconv.FormatFloat(*p[0], 'f', -1, 64)
+			}
+			count++
+		}
+	}
+	return updates, count, http.StatusOK, nil
+}
+
+// updateRRD writes "timestamp:value:value..." lines to an RRD file, through
+// rrdcached if the root uses it
+func (root *rrdRoot) updateRRD(filePath string, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if root.cached() {
+		updates := make([]rrdcached.Update, len(lines))
+		for i, line := range lines {
+			updates[i] = rrdcached.Update(line)
+		}
+		// An update isn't retried, as it may have been applied before the
+		// connection failed
+		err := root.rrdcached.with(func(client *rrdcached.Client) error {
+			return client.Update(filePath, updates[0], updates[1:]...)
+		})
+		if err != nil && (strings.Contains(err.Error(), "timeout") || strings.Contains(err.Error(), "connection")) {
+			root.rrdcached.reconnect()
+		}
+		return err
+	}
+
+	updater := rrd.NewUpdater(filePath)
+	for _, line := range lines {
+		updater.Cache(line)
+	}
+	return updater.Update()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	// Updates go to a copy, so the sample files stay as they are
+	dir := t.TempDir()
+	config := sampleConfig()
+	config.Roots = []RootConfig{{Name: "tmp", Path: dir}}
+	s := newTestServer(t, config)
+	filePath := filepath.Join(dir, "port-id66.rrd")
+	copyFile(t, "./sample/librenms/host/port-id66.rrd", filePath)
+	header, err := s.roots[0].cachedInfo(filePath)
+	if err != nil {
+		t.Fatalf("Cannot read info. %v", err)
+	}
+	next := header.LastUpdate.Unix() + 300
+
+	ts := httptest.NewServer(s.withAuth(authWrite, s.update))
+	defer ts.Close()
+
+	post := func(token, body string) (int, string) {
+		req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error at an POST request. %v", err)
+		}
+		var res json.RawMessage
+		json.NewDecoder(r.Body).Decode(&res)
+		return r.StatusCode, string(res)
+	}
+
+	body := fmt.Sprintf(`[
+	  {"target":"tmp:port-id66:INOCTETS","datapoints":[[100,%d000],[200,%d000]]},
+	  {"target":"tmp:port-id66:OUTOCTETS","datapoints":[[null,%d000]]}
+	]`, next, next+300, next)
+
+	if status, _ := post("secret", body); status != http.StatusForbidden {
+		t.Fatalf("Writes should be disabled without a token but %d.", status)
+	}
+	s.config.Server.WriteToken = "secret"
+	if status, _ := post("wrong", body); status != http.StatusUnauthorized {
+		t.Fatalf("A wrong token should be rejected but %d.", status)
+	}
+
+	status, res := post("secret", body)
+	if status != http.StatusOK || res != `{"updated":3}` {
+		t.Fatalf("Unexpected response. %d %s", status, res)
+	}
+
+	for body, expected := range map[string]int{
+		`{"target":"tmp:port-id66:NOSUCHDS","datapoints":[[1,1000]]}`:     http.StatusNotFound,
+		`{"target":"tmp:..:..:etc:passwd:x","datapoints":[[1,1000]]}`:     http.StatusNotFound,
+		`{"target":"tmp:port-id66:INOCTETS@MAX","datapoints":[[1,1000]]}`: http.StatusBadRequest,
+		`{"target":"tmp:port-id66:INOCTETS","datapoints":[[1]]}`:          http.StatusBadRequest,
+	} {
+		if status, res := post("secret", body); status != expected {
+			t.Fatalf("Expected %d for %s but %d. %s", expected, body, status, res)
+		}
+	}
+	// Writers with access rules can't update files outside their paths
+	s.config.Auth = AuthConfig{
+		Tokens: []TokenConfig{{Name: "alice", Token: "alice-token"}},
+		Read:   []string{"alice"},
+		Write:  []string{"alice"},
+		Access: []AccessConfig{{Users: []string{"alice"}, Paths: []string{"tmp:other"}}},
+	}
+	later := fmt.Sprintf(`{"target":"tmp:port-id66:INOCTETS","datapoints":[[1,%d000]]}`, next+600)
+	if status, res := post("alice-token", later); status != http.StatusNotFound {
+		t.Fatalf("Alice shouldn't update port-id66 but %d. %s", status, res)
+	}
+}
+
+func TestCollectUpdates(t *testing.T) {
+	s := sampleServer(t)
+
+	one, two := 1.0, 2.0
+	updates, count, _, err := s.collectUpdates([]UpdateRequest{
+		{Target: "librenms:host:port-id66:INOCTETS", DataPoints: [][]*float64{{&one, floatPtr(2000500)}}},
+		{Target: "librenms:host:port-id66:OUTOCTETS", DataPoints: [][]*float64{{&two, floatPtr(2000000)}}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Cannot collect updates. %v", err)
+	}
+	if count != 2 || len(updates) != 1 || len(updates[0].rows) != 1 {
+		t.Fatalf("Samples of one file and second should be merged. %d %v", count, updates)
+	}
+	row := updates[0].rows[2000]
+	in, out := updates[0].dsIndex["INOCTETS"], updates[0].dsIndex["OUTOCTETS"]
+	if row[in] != "1" || row[out] != "2" {
+		t.Fatalf("Unexpected row. %v", row)
+	}
+	for i, value := range row {
+		if i != in && i != out && value != "U" {
+			t.Fatalf("DSes without samples should be unknown. %v", row)
+		}
+	}
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// With -watch the search cache follows filesystem events between the full
+// rescans: only the files that are created or removed are read or dropped.
+// The periodic rescan is kept as a fallback for lost events.
+
+// watchRoots watches every directory of the roots and updates cache from the
+// events until the returned watcher is closed
+func watchRoots(cache *SearchCache) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, root := range cache.roots {
+		if err := addWatchTree(watcher, root.path, nil); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				handleWatchEvent(watcher, cache, event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Filesystem watcher error", "error", err)
+				if errors.Is(err, fsnotify.ErrEventOverflow) {
+					// Events were lost, so only a full rescan can catch up
+					go cache.Update()
+				}
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+// addWatchTree watches dir and its subdirectories, calling found for each RRD
+// file in them
+func addWatchTree(watcher *fsnotify.Watcher, dir string, found func(path string)) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		if found != nil && isRRDFile(info.Name()) {
+			found(path)
+		}
+		return nil
+	})
+}
+
+func handleWatchEvent(watcher *fsnotify.Watcher, cache *SearchCache, event fsnotify.Event) {
+	switch {
+	case event.Has(fsnotify.Create):
+		info, err := os.Stat(event.Name)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			// Files may have been created before the watch was added
+			err := addWatchTree(watcher, event.Name, func(path string) {
+				updateWatchedFile(cache, path, false)
+			})
+			if err != nil {
+				logger.Error("Cannot watch directory", "path", event.Name, "error", err)
+			}
+			return
+		}
+		if isRRDFile(info.Name()) {
+			updateWatchedFile(cache, event.Name, false)
+		}
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		// The path is gone, so it can't be told whether it was a directory
+		if isRRDFile(filepath.Base(event.Name)) {
+			updateWatchedFile(cache, event.Name, false)
+		}
+		for _, root := range cache.roots.containing(event.Name) {
+			cache.RemoveDir(root, event.Name)
+		}
+	case event.Has(fsnotify.Write):
+		// Updates don't change the data sources, so a write only matters for
+		// a file whose header couldn't be read when it was created
+		if isRRDFile(filepath.Base(event.Name)) {
+			updateWatchedFile(cache, event.Name, true)
+		}
+	}
+}
+
+// updateWatchedFile updates the entries of a file in every root holding it.
+// With onlyNew, files already in the cache are left alone.
+func updateWatchedFile(cache *SearchCache, path string, onlyNew bool) {
+	for _, root := range cache.roots.containing(path) {
+		if onlyNew && cache.HasFile(root.target(path)) {
+			continue
+		}
+		cache.UpdateFile(root, path)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func copyFile(t *testing.T, src, dst string) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("Cannot read %s. %v", src, err)
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		t.Fatalf("Cannot write %s. %v", dst, err)
+	}
+}
+
+// waitFor polls until f is true, as watch events are handled asynchronously
+func waitFor(t *testing.T, what string, f func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if f() {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %s.", what)
+}
+
+func TestWatchRoots(t *testing.T) {
+	dir := t.TempDir()
+	config := sampleConfig()
+	config.Roots = []RootConfig{{Name: "tmp", Path: dir}}
+	roots, err := setupRoots(config)
+	if err != nil {
+		t.Fatalf("Cannot set up roots. %v", err)
+	}
+
+	cache := NewSearchCache(roots)
+	cache.Update()
+	watcher, err := watchRoots(cache)
+	if err != nil {
+		t.Fatalf("Cannot watch roots. %v", err)
+	}
+	defer watcher.Close()
+
+	copyFile(t, "./sample/percent/percent-idle.rrd", filepath.Join(dir, "percent-idle.rrd"))
+	waitFor(t, "a new file", func() bool { return cache.HasFile("tmp:percent-idle") })
+	if items := cache.Get(); len(items) != 1 || items[0] != "tmp:percent-idle:value" {
+		t.Fatalf("Unexpected items. %v", items)
+	}
+
+	// Files created with their directory are found when the watch is added
+	sub := filepath.Join(dir, "host")
+	os.Mkdir(sub, 0755)
+	copyFile(t, "./sample/percent/percent-user.rrd", filepath.Join(sub, "percent-user.rrd"))
+	waitFor(t, "a file in a new directory", func() bool { return cache.HasFile("tmp:host:percent-user") })
+
+	os.Remove(filepath.Join(dir, "percent-idle.rrd"))
+	waitFor(t, "a removed file", func() bool { return !cache.HasFile("tmp:percent-idle") })
+
+	os.RemoveAll(sub)
+	waitFor(t, "a removed directory", func() bool { return len(cache.Get()) == 0 })
+}
+
+func TestCachedInfo(t *testing.T) {
+	dir := t.TempDir()
+	config := sampleConfig()
+	config.Roots = []RootConfig{{Path: dir}}
+	roots, err := setupRoots(config)
+	if err != nil {
+		t.Fatalf("Cannot set up roots. %v", err)
+	}
+	filePath := filepath.Join(dir, "percent-idle.rrd")
+	copyFile(t, "./sample/percent/percent-idle.rrd", filePath)
+
+	first, err := roots[0].cachedInfo(filePath)
+	if err != nil {
+		t.Fatalf("Cannot read info. %v", err)
+	}
+	if second, _ := roots[0].cachedInfo(filePath); second != first {
+		t.Fatal("An unchanged file shouldn't be read again.")
+	}
+
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filePath, later, later)
+	if third, _ := roots[0].cachedInfo(filePath); third == first {
+		t.Fatal("A modified file should be read again.")
+	}
+
+	infoCache.retain(map[string]bool{})
+	if _, ok := infoCache.entries[filePath]; ok {
+		t.Fatal("Entries of files that are gone should be dropped.")
+	}
+}